@@ -0,0 +1,169 @@
+package receiver
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const maxBuckets = 100000
+
+// bucketColumns are the numeric columns of the readings table that are
+// aggregated into buckets.
+var bucketColumns = []string{
+	"timestamp_drift",
+	"amplitude",
+	"period",
+	"beat_error",
+	"rate",
+	"rate_smoothed",
+	"accumulated_error",
+	"fit_period",
+	"fit_amplitude",
+	"fit_beat_error",
+	"fit_residual",
+	"q_factor",
+	"impulse_fraction",
+	"impulse_energy",
+	"unlock_time",
+	"drop_time",
+	"impulse_magnitude",
+	"peak_velocity",
+	"velocity_amplitude",
+	"bmp180_temperature",
+	"bmp180_pressure",
+	"bmp390_temperature",
+	"bmp390_pressure",
+	"sht85_temperature",
+	"sht85_humidity",
+	"bmp180_age",
+	"bmp390_age",
+	"sht85_age",
+	"clock_offset",
+	"clock_skew_ppm",
+	"lost_steps",
+}
+
+// BucketStats summarizes one column's values within a bucket. The mean,
+// min and max are null if the column had no values there.
+type BucketStats struct {
+	Count int      `json:"count"`
+	Mean  *float64 `json:"mean"`
+	Min   *float64 `json:"min"`
+	Max   *float64 `json:"max"`
+}
+
+// HistoricalBucket aggregates the cycles recorded in one interval of time.
+// Intervals with no cycles are left out.
+type HistoricalBucket struct {
+	Start       int64                  `json:"start"` // Bucket bounds in total_micros, end exclusive unless it's the largest int64
+	End         int64                  `json:"end"`
+	TotalMicros int64                  `json:"total_micros"` // Mean time of the bucket's cycles
+	Count       int                    `json:"count"`
+	Columns     map[string]BucketStats `json:"columns"`
+}
+
+// BucketWidth returns the width in micros of buckets dividing the range
+// from startTime to endTime into at most points buckets. It fails if the
+// range is empty or the width doesn't fit in an int64.
+func BucketWidth(startTime, endTime int64, points int) (int64, error) {
+	if points <= 0 {
+		return 0, errors.New("point count must be positive")
+	}
+	if endTime < startTime {
+		return 0, errors.New("end is before start")
+	}
+	startTime = bucketStart(startTime, endTime)
+	// Unsigned, as the span of the widest ranges overflows an int64
+	span := uint64(endTime) - uint64(startTime)
+	width := span/uint64(points) + 1
+	if width == 0 || width > math.MaxInt64 {
+		return 0, errors.New("range is too long")
+	}
+	return int64(width), nil
+}
+
+// bucketStart returns where the buckets dividing the range from startTime
+// to endTime start. No reading is from before the Unix epoch, so that's as
+// early as they need to go, and starting there keeps bucket arithmetic
+// from overflowing.
+func bucketStart(startTime, endTime int64) int64 {
+	return max(startTime, min(endTime, 0))
+}
+
+// bucketCount returns how many buckets of width micros the range from
+// startTime to endTime starts, without overflowing.
+func bucketCount(startTime, endTime, width int64) uint64 {
+	if endTime < startTime {
+		return 0
+	}
+	startTime = bucketStart(startTime, endTime)
+	return (uint64(endTime)-uint64(startTime))/uint64(width) + 1
+}
+
+// GetHistoricalBuckets aggregates the cycles recorded between startTime and
+// endTime into buckets of width micros. The aggregation is done by SQLite,
+// so only the buckets are held in memory.
+func (dr *DataRecorder) GetHistoricalBuckets(startTime, endTime, width int64) ([]HistoricalBucket, error) {
+	if width <= 0 {
+		return nil, errors.New("bucket width must be positive")
+	}
+	if bucketCount(startTime, endTime, width) > maxBuckets {
+		return nil, fmt.Errorf("more than %d buckets", maxBuckets)
+	}
+	startTime = bucketStart(startTime, endTime)
+
+	aggregates := make([]string, len(bucketColumns))
+	for i, column := range bucketColumns {
+		aggregates[i] = fmt.Sprintf("COUNT(%[1]s), AVG(%[1]s), MIN(%[1]s), MAX(%[1]s)", column)
+	}
+	rows, err := dr.db.Query(fmt.Sprintf(`
+		SELECT (total_micros - ?) / ? AS bucket, COUNT(*), AVG(total_micros), %s
+		FROM readings
+		WHERE clock_id = ? AND total_micros BETWEEN ? AND ?
+		GROUP BY bucket
+		ORDER BY bucket ASC
+	`, strings.Join(aggregates, ", ")), startTime, width, dr.clockID, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []HistoricalBucket
+	for rows.Next() {
+		var index int64
+		var meanTime float64
+		bucket := HistoricalBucket{Columns: make(map[string]BucketStats, len(bucketColumns))}
+		stats := make([]BucketStats, len(bucketColumns))
+		values := make([]sql.NullFloat64, 3*len(bucketColumns))
+
+		dest := []any{&index, &bucket.Count, &meanTime}
+		for i := range stats {
+			dest = append(dest, &stats[i].Count, &values[3*i], &values[3*i+1], &values[3*i+2])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		bucket.Start = startTime + index*width
+		bucket.End = bucket.Start + min(width, math.MaxInt64-bucket.Start)
+		bucket.TotalMicros = int64(meanTime)
+		for i, column := range bucketColumns {
+			stats[i].Mean = nullableFloat(values[3*i])
+			stats[i].Min = nullableFloat(values[3*i+1])
+			stats[i].Max = nullableFloat(values[3*i+2])
+			bucket.Columns[column] = stats[i]
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, rows.Err()
+}
+
+func nullableFloat(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Float64
+}
@@ -0,0 +1,84 @@
+package receiver
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGetHistoricalBucketsExtremes(t *testing.T) {
+	db := openTestDatabase(t)
+	if _, err := MigrateDatabase(db, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, micros := range []int64{0, 1000000, math.MaxInt64} {
+		_, err := db.Exec("INSERT INTO readings (clock_id, total_micros, amplitude, period) VALUES (?, ?, 240, 1.0)",
+			DefaultClockID, micros)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dr := NewDataRecorder(db, DefaultClockID)
+
+	tests := []struct {
+		name        string
+		start       int64
+		end         int64
+		wantWidth   int64
+		wantBuckets []int64 // Start of each bucket
+	}{
+		{
+			name:        "from the epoch",
+			start:       0,
+			end:         1999999,
+			wantWidth:   2000,
+			wantBuckets: []int64{0, 1000000},
+		},
+		{
+			name:        "from before the epoch",
+			start:       -1000000,
+			end:         1999999,
+			wantWidth:   2000,
+			wantBuckets: []int64{0, 1000000},
+		},
+		{
+			name:        "every int64",
+			start:       math.MinInt64,
+			end:         math.MaxInt64,
+			wantWidth:   math.MaxInt64/1000 + 1,
+			wantBuckets: []int64{0, 999 * (math.MaxInt64/1000 + 1)},
+		},
+		{
+			name:      "before the epoch",
+			start:     math.MinInt64,
+			end:       -1,
+			wantWidth: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, err := BucketWidth(tt.start, tt.end, 1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if width != tt.wantWidth {
+				t.Errorf("BucketWidth() = %d, want %d", width, tt.wantWidth)
+			}
+
+			buckets, err := dr.GetHistoricalBuckets(tt.start, tt.end, width)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(buckets) != len(tt.wantBuckets) {
+				t.Fatalf("%d buckets, want %d", len(buckets), len(tt.wantBuckets))
+			}
+			for i, bucket := range buckets {
+				if bucket.Start != tt.wantBuckets[i] {
+					t.Errorf("bucket %d starts at %d, want %d", i, bucket.Start, tt.wantBuckets[i])
+				}
+				if bucket.End <= bucket.Start {
+					t.Errorf("bucket %d ends at %d, before its start %d", i, bucket.End, bucket.Start)
+				}
+			}
+		})
+	}
+}
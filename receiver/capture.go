@@ -0,0 +1,308 @@
+package receiver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Capture files start with captureMagic and then hold a sequence of records,
+// each an 8-byte host receive time in Unix micros, a 4-byte length and that
+// many bytes exactly as they were read from the encoder. All integers are
+// big-endian.
+const captureMagic = "CWCAP001"
+
+const maxCaptureChunk = 1 << 20
+
+// CaptureWriter appends raw encoder bytes to a capture file.
+type CaptureWriter struct {
+	mu        sync.Mutex
+	file      *os.File
+	w         *bufio.Writer
+	lastFlush time.Time
+}
+
+func NewCaptureWriter(path string) (*CaptureWriter, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	cw := &CaptureWriter{
+		file: file,
+		w:    bufio.NewWriter(file),
+	}
+
+	if info.Size() == 0 {
+		if _, err := cw.w.WriteString(captureMagic); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return cw, nil
+	}
+
+	// Appending to an existing capture continues its record stream, after
+	// dropping any record cut short by a crash
+	end, err := captureLength(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if end < info.Size() {
+		log.Printf("Dropping %d bytes of incomplete record from the end of %s", info.Size()-end, path)
+		if err := file.Truncate(end); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if _, err := file.Seek(end, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return cw, nil
+}
+
+// captureLength checks that file is a capture file, and returns its length
+// up to the end of its last complete record.
+func captureLength(file *os.File) (int64, error) {
+	r := bufio.NewReader(file)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != captureMagic {
+		return 0, errors.New("not a capture file")
+	}
+
+	end := int64(len(captureMagic))
+	for {
+		var header [12]byte
+		_, err := io.ReadFull(r, header[:])
+		if err == nil {
+			size := binary.BigEndian.Uint32(header[8:12])
+			if size > maxCaptureChunk {
+				return end, nil // Garbage left by the crash
+			}
+			_, err = io.CopyN(io.Discard, r, int64(size))
+			if err == nil {
+				end += int64(len(header)) + int64(size)
+				continue
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return end, nil
+		}
+		return 0, err
+	}
+}
+
+// Write records bytes that arrived at hostMicros.
+func (cw *CaptureWriter) Write(hostMicros int64, p []byte) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	var header [12]byte
+	binary.BigEndian.PutUint64(header[0:8], uint64(hostMicros))
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(p)))
+	if _, err := cw.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := cw.w.Write(p); err != nil {
+		return err
+	}
+
+	// Flush at most once a second so a crash loses little
+	if time.Since(cw.lastFlush) > time.Second {
+		cw.lastFlush = time.Now()
+		return cw.w.Flush()
+	}
+	return nil
+}
+
+func (cw *CaptureWriter) Close() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	if err := cw.w.Flush(); err != nil {
+		cw.file.Close()
+		return err
+	}
+	return cw.file.Close()
+}
+
+// captureTransport records everything read from the underlying transport.
+type captureTransport struct {
+	Transport
+	capture *CaptureWriter
+	failed  bool // Capture stops at the first failed write
+}
+
+func newCaptureTransport(t Transport, capture *CaptureWriter) Transport {
+	return &captureTransport{Transport: t, capture: capture}
+}
+
+func (ct *captureTransport) Read(p []byte) (int, error) {
+	n, err := ct.Transport.Read(p)
+	if n > 0 && !ct.failed {
+		// A failed capture shouldn't take the encoder down with it
+		if werr := ct.capture.Write(ct.Now(), p[:n]); werr != nil {
+			log.Printf("Capture write failed, no longer capturing: %v", werr)
+			ct.failed = true
+		}
+	}
+	return n, err
+}
+
+// Now passes through the underlying transport's clock, if it has one.
+func (ct *captureTransport) Now() int64 {
+	if clock, ok := ct.Transport.(transportClock); ok {
+		return clock.Now()
+	}
+	return time.Now().UnixMicro()
+}
+
+func (ct *captureTransport) Close() error {
+	ct.capture.Close()
+	return ct.Transport.Close()
+}
+
+// ReplayPort plays back a capture file as though it were a live serial port.
+// It implements serial.Port, and so also Transport.
+type ReplayPort struct {
+	file     *os.File
+	r        *bufio.Reader
+	realtime bool
+	pending  []byte
+	chunkAt  int64 // Host time of the chunk currently being read
+	firstAt  int64
+	started  time.Time
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// OpenReplay opens a capture file. With realtime set, reads are paced to
+// match the original arrival times; otherwise the capture is replayed as
+// fast as it can be consumed.
+func OpenReplay(path string, realtime bool) (*ReplayPort, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(file)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != captureMagic {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a capture file", path)
+	}
+
+	return &ReplayPort{
+		file:     file,
+		r:        r,
+		realtime: realtime,
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+func (rp *ReplayPort) Read(p []byte) (int, error) {
+	select {
+	case <-rp.closed:
+		return 0, errors.New("replay closed")
+	default:
+	}
+
+	if len(rp.pending) == 0 {
+		if err := rp.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, rp.pending)
+	rp.pending = rp.pending[n:]
+	return n, nil
+}
+
+func (rp *ReplayPort) nextChunk() error {
+	var header [12]byte
+	if _, err := io.ReadFull(rp.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF // A truncated final record is just the end
+		}
+		return err
+	}
+	at := int64(binary.BigEndian.Uint64(header[0:8]))
+	size := binary.BigEndian.Uint32(header[8:12])
+	if size > maxCaptureChunk {
+		return fmt.Errorf("corrupt capture record of %d bytes", size)
+	}
+
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(rp.r, chunk); err != nil {
+		return io.EOF
+	}
+
+	if rp.firstAt == 0 {
+		rp.firstAt = at
+		rp.started = time.Now()
+	}
+	if rp.realtime {
+		wait := time.Duration(at-rp.firstAt)*time.Microsecond - time.Since(rp.started)
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-rp.closed:
+				return errors.New("replay closed")
+			}
+		}
+	}
+
+	rp.chunkAt = at
+	rp.pending = chunk
+	return nil
+}
+
+// Now returns the recorded host time of the bytes most recently read, for
+// use as a SerialReader clock.
+func (rp *ReplayPort) Now() int64 {
+	return rp.chunkAt
+}
+
+func (rp *ReplayPort) Close() error {
+	rp.once.Do(func() { close(rp.closed) })
+	return rp.file.Close()
+}
+
+// The remaining serial.Port methods have nothing to control on a replay.
+
+func (rp *ReplayPort) SetMode(mode *serial.Mode) error { return nil }
+
+func (rp *ReplayPort) Write(p []byte) (int, error) { return len(p), nil }
+
+func (rp *ReplayPort) Drain() error { return nil }
+
+func (rp *ReplayPort) ResetInputBuffer() error { return nil }
+
+func (rp *ReplayPort) ResetOutputBuffer() error { return nil }
+
+func (rp *ReplayPort) SetDTR(dtr bool) error { return nil }
+
+func (rp *ReplayPort) SetRTS(rts bool) error { return nil }
+
+func (rp *ReplayPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
+
+func (rp *ReplayPort) SetReadTimeout(t time.Duration) error { return nil }
+
+func (rp *ReplayPort) Break(d time.Duration) error { return nil }
@@ -0,0 +1,343 @@
+package receiver
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// DefaultClockID is used by requests that don't name a clock, and for
+// records made before multiple clocks were supported.
+const DefaultClockID = "default"
+
+var clockIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Clock is one monitored clock: an encoder input with its own reader, tare
+// and analysis.
+type Clock struct {
+	ID     string
+	server *Server
+
+	// The reader sends here, and forward tags everything with the clock ID
+	// before passing it on to the server
+	readings    chan Reading
+	statusChan  chan StatusMessage
+	stopForward chan struct{}
+	forwarded   chan struct{} // Closed once forward has passed on everything and returned
+
+	serialMux     sync.Mutex
+	transport     Transport
+	reader        *SerialReader
+	connGen       int              // Incremented whenever the reader is replaced or stopped
+	lastTransport *TransportConfig // Reopened automatically if the connection fails
+	portIdentity  *portIdentity
+	simulator     *Simulator // Set while the encoder input is simulated
+	linkStats     *LinkStats
+
+	configMux    sync.Mutex
+	config       ClockConfig
+	tareOffset   int
+	dataRecorder *DataRecorder
+}
+
+func newClock(id string, server *Server) *Clock {
+	c := &Clock{
+		ID:          id,
+		server:      server,
+		readings:    make(chan Reading, 1024), // Absorbs bursts; a full buffer counts as a stall
+		statusChan:  make(chan StatusMessage),
+		stopForward: make(chan struct{}),
+		forwarded:   make(chan struct{}),
+		linkStats:   NewLinkStats(),
+		config:      DefaultClockConfig(),
+	}
+	if server.db != nil {
+		config, err := LoadClockConfig(server.db, id)
+		if err != nil {
+			log.Printf("Clock %s: failed to load config, using defaults: %v", id, err)
+		}
+		c.config = config
+		c.dataRecorder = NewDataRecorder(server.db, id)
+		c.dataRecorder.SetConfig(config)
+		c.dataRecorder.SetTraceRetention(server.config.TraceRetention)
+		c.dataRecorder.SetSensorMaxAge(server.config.SensorMaxAge)
+		c.dataRecorder.setWriter(server.writer)
+	}
+	go c.forward()
+	return c
+}
+
+func (c *Clock) forward() {
+	defer close(c.forwarded)
+	for {
+		select {
+		case reading := <-c.readings:
+			reading.ClockID = c.ID
+			c.server.readings <- reading
+		case status := <-c.statusChan:
+			status.ClockID = c.ID
+			c.server.statusChan <- status
+		case <-c.stopForward:
+			for {
+				select {
+				case reading := <-c.readings:
+					reading.ClockID = c.ID
+					c.server.readings <- reading
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush passes on every reading still queued and stops forward. The reader
+// must already be stopped, so that nothing more is queued.
+func (c *Clock) flush() {
+	close(c.stopForward)
+	<-c.forwarded
+}
+
+// Config returns the clock's current settings.
+func (c *Clock) Config() ClockConfig {
+	c.configMux.Lock()
+	defer c.configMux.Unlock()
+	return c.config
+}
+
+// SetConfig validates, stores and applies new settings.
+func (c *Clock) SetConfig(config ClockConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	c.configMux.Lock()
+	defer c.configMux.Unlock()
+
+	if c.server.db != nil {
+		if err := SaveClockConfig(c.server.db, c.ID, config); err != nil {
+			return err
+		}
+	}
+	c.config = config
+	if c.dataRecorder != nil {
+		c.dataRecorder.SetConfig(config)
+	}
+	return nil
+}
+
+// TareOffset returns the user-set zero, in degrees.
+func (c *Clock) TareOffset() int {
+	c.configMux.Lock()
+	defer c.configMux.Unlock()
+	return c.tareOffset
+}
+
+// SetTareOffset sets the user-set zero, which applies from the next
+// reading.
+func (c *Clock) SetTareOffset(offset int) {
+	c.configMux.Lock()
+	defer c.configMux.Unlock()
+	c.tareOffset = offset
+}
+
+// Connect opens the given encoder transport and starts reading from it,
+// replacing any existing connection. If the connection later fails it is
+// reopened automatically.
+func (c *Clock) Connect(tc TransportConfig) error {
+	// Sending the status can block, so it's done without serialMux held
+	if err := c.connect(tc); err != nil {
+		log.Printf("Clock %s: failed to open %s: %v", c.ID, tc, err)
+		c.statusChan <- StatusMessage{
+			Device: DeviceTypeSerial,
+			Status: StatusError,
+			Error:  err.Error(),
+		}
+		return err
+	}
+
+	log.Printf("Clock %s: connected to %s", c.ID, tc)
+	return nil
+}
+
+func (c *Clock) connect(tc TransportConfig) error {
+	c.serialMux.Lock()
+	defer c.serialMux.Unlock()
+
+	// Close existing transport if connected
+	c.stopReader()
+
+	transport, err := c.openTransport(tc)
+	if err != nil {
+		return err
+	}
+
+	c.lastTransport = &tc
+	c.portIdentity = lookupPortIdentity(tc)
+	// Look through the capture wrapper, if any, for a simulator
+	source := transport
+	if ct, ok := source.(*captureTransport); ok {
+		source = ct.Transport
+	}
+	if sim, ok := source.(*Simulator); ok {
+		c.simulator = sim
+		c.lastTransport = nil // A finished simulation shouldn't restart
+	}
+	c.startReader(transport)
+	return nil
+}
+
+// disconnect stops reading from the encoder, and stops it being reopened.
+func (c *Clock) disconnect() {
+	c.serialMux.Lock()
+	defer c.serialMux.Unlock()
+
+	c.stopReader()
+	c.lastTransport = nil
+}
+
+// StartReplay feeds a capture file through the same pipeline as a live
+// serial port, replacing any existing connection.
+func (c *Clock) StartReplay(path string, realtime bool) error {
+	replay, err := OpenReplay(path, realtime)
+	if err != nil {
+		return err
+	}
+
+	c.serialMux.Lock()
+	defer c.serialMux.Unlock()
+
+	c.stopReader()
+	c.lastTransport = nil // Nothing to reconnect to when the replay ends
+	c.startReader(replay)
+
+	log.Printf("Clock %s: replaying capture %s", c.ID, path)
+	return nil
+}
+
+// openTransport opens tc, wrapping it for capture if configured. Must be
+// called with serialMux held.
+func (c *Clock) openTransport(tc TransportConfig) (Transport, error) {
+	transport, err := OpenTransport(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	if path := c.capturePath(); path != "" {
+		capture, err := NewCaptureWriter(path)
+		if err != nil {
+			log.Printf("Failed to open capture file %s: %v", path, err)
+		} else {
+			transport = newCaptureTransport(transport, capture)
+		}
+	}
+	return transport, nil
+}
+
+// capturePath returns the configured capture file, with the clock ID added
+// before the extension for all but the default clock so that clocks don't
+// interleave their bytes in one file.
+func (c *Clock) capturePath() string {
+	path := c.server.config.CapturePath
+	if path == "" || c.ID == DefaultClockID {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(path, ext), c.ID, ext)
+}
+
+// startReader starts a SerialReader on transport. Must be called with
+// serialMux held.
+func (c *Clock) startReader(transport Transport) {
+	c.connGen++
+	gen := c.connGen
+
+	reader := NewSerialReader(transport, c.statusChan)
+	reader.SetStats(c.linkStats)
+	if clock, ok := transport.(transportClock); ok {
+		reader.SetClock(clock.Now)
+	}
+	c.transport = transport
+	c.reader = reader
+
+	go func() {
+		reader.StartReading(c.readings)
+		c.readerStopped(gen)
+	}()
+}
+
+// stopReader closes the current reader, if any, and waits for it to finish
+// so that its status messages aren't interleaved with its replacement's.
+// Must be called with serialMux held.
+func (c *Clock) stopReader() {
+	c.connGen++ // Don't let the old reader trigger a reconnect
+	if c.reader != nil {
+		c.reader.Close()
+		<-c.reader.Done()
+	}
+	c.reader = nil
+	c.transport = nil
+	c.simulator = nil
+}
+
+// readerStopped is called when a reader's StartReading returns. If nothing
+// replaced or stopped the reader on purpose, the connection failed and we
+// start trying to reopen it.
+func (c *Clock) readerStopped(gen int) {
+	c.serialMux.Lock()
+	defer c.serialMux.Unlock()
+
+	if gen != c.connGen {
+		return
+	}
+	c.reader = nil
+	c.transport = nil
+
+	if c.lastTransport != nil {
+		go c.reconnect(gen, *c.lastTransport)
+	}
+}
+
+// ClockInfo describes a clock for the /clocks endpoint.
+type ClockInfo struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Transport string `json:"transport,omitempty"`
+}
+
+func (c *Clock) Info() ClockInfo {
+	c.serialMux.Lock()
+	defer c.serialMux.Unlock()
+
+	info := ClockInfo{ID: c.ID, Status: StatusDisconnected}
+	if c.transport != nil {
+		info.Status = StatusConnected
+	}
+	if c.lastTransport != nil {
+		info.Transport = c.lastTransport.String()
+	}
+	return info
+}
+
+func (c *Clock) currentSerialStatus() StatusMessage {
+	return StatusMessage{
+		Device:  DeviceTypeSerial,
+		ClockID: c.ID,
+		Status:  c.Info().Status,
+	}
+}
+
+func (c *Clock) currentSimulator() *Simulator {
+	c.serialMux.Lock()
+	defer c.serialMux.Unlock()
+	return c.simulator
+}
+
+func (c *Clock) currentReader() *SerialReader {
+	c.serialMux.Lock()
+	defer c.serialMux.Unlock()
+	return c.reader
+}
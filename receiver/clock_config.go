@@ -0,0 +1,106 @@
+package receiver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ClockConfig holds the per-clock settings, which are kept in the database
+// so they survive restarts.
+type ClockConfig struct {
+	Geometry EncoderGeometry `json:"geometry"`
+
+	// The clock's intended period, given either directly or as beats per
+	// hour. Rates aren't computed until one of them is set.
+	NominalPeriod float64 `json:"nominal_period"` // Seconds per oscillation
+	BPH           float64 `json:"bph"`            // Beats per hour, two per oscillation
+	RateSmoothing float64 `json:"rate_smoothing"` // Time constant of the smoothed rate in seconds
+
+	// The balance wheel's or pendulum's moment of inertia in kg·m², for
+	// converting the impulse into energy. Optional.
+	MomentOfInertia float64 `json:"moment_of_inertia"`
+
+	// Savitzky–Golay smoothing of velocity and acceleration: the number of
+	// encoder edges in each fit, which must be odd, and the degree of the
+	// polynomial fitted to them.
+	KinematicsWindow int `json:"kinematics_window"`
+	KinematicsOrder  int `json:"kinematics_order"`
+}
+
+func DefaultClockConfig() ClockConfig {
+	return ClockConfig{
+		Geometry:         DefaultEncoderGeometry(),
+		RateSmoothing:    300,
+		KinematicsWindow: 9,
+		KinematicsOrder:  2,
+	}
+}
+
+func (cc ClockConfig) Validate() error {
+	if cc.NominalPeriod < 0 || cc.BPH < 0 {
+		return errors.New("nominal_period and bph must not be negative")
+	}
+	if cc.NominalPeriod > 0 && cc.BPH > 0 {
+		return errors.New("only one of nominal_period and bph may be set")
+	}
+	if cc.RateSmoothing < 0 || cc.MomentOfInertia < 0 {
+		return errors.New("rate_smoothing and moment_of_inertia must not be negative")
+	}
+	if cc.KinematicsOrder < 2 || cc.KinematicsOrder > 4 {
+		return errors.New("kinematics_order must be from 2 to 4")
+	}
+	if cc.KinematicsWindow%2 == 0 || cc.KinematicsWindow <= cc.KinematicsOrder+1 {
+		return errors.New("kinematics_window must be odd and more than kinematics_order + 1")
+	}
+	return cc.Geometry.Validate()
+}
+
+// Period returns the nominal period in seconds, or 0 if it isn't set.
+func (cc ClockConfig) Period() float64 {
+	if cc.NominalPeriod > 0 {
+		return cc.NominalPeriod
+	}
+	if cc.BPH > 0 {
+		return 2 * 3600 / cc.BPH
+	}
+	return 0
+}
+
+// LoadClockConfig returns the stored config for clockID, or the default
+// config if none has been saved or the saved one is invalid.
+func LoadClockConfig(db *sql.DB, clockID string) (ClockConfig, error) {
+	config := DefaultClockConfig()
+
+	var data string
+	err := db.QueryRow("SELECT config FROM clock_config WHERE clock_id = ?", clockID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+
+	// Unmarshalling over the defaults fills in settings added since it was saved
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		return DefaultClockConfig(), err
+	}
+	// A bad stored config would otherwise reach the rate and geometry maths
+	if err := config.Validate(); err != nil {
+		return DefaultClockConfig(), fmt.Errorf("invalid stored config: %w", err)
+	}
+	return config, nil
+}
+
+func SaveClockConfig(db *sql.DB, clockID string, config ClockConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO clock_config (clock_id, config) VALUES (?, ?)
+		ON CONFLICT (clock_id) DO UPDATE SET config = excluded.config
+	`, clockID, string(data))
+	return err
+}
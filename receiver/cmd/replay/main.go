@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"receiver"
+)
+
+func main() {
+	dbPath := flag.String("db", "replay.db", "SQLite database to write cycle records to")
+	realtime := flag.Bool("realtime", false, "pace replay at the original speed")
+	tare := flag.Int("tare", 0, "tare offset in degrees")
+	clockID := flag.String("clock", receiver.DefaultClockID, "clock ID to record under")
+	nominal := flag.Float64("nominal", 0, "nominal period in seconds, to compute rates")
+	geometry := receiver.DefaultEncoderGeometry()
+	flag.IntVar(&geometry.Resolution, "resolution", geometry.Resolution, "encoder lines per revolution")
+	flag.IntVar(&geometry.CountsPerRevolution, "counts-per-rev", 0, "encoder counts per revolution, if not 4 × resolution")
+	flag.Float64Var(&geometry.GearRatio, "gear-ratio", geometry.GearRatio, "encoder revolutions per balance revolution")
+	flag.BoolVar(&geometry.Inverted, "invert", false, "counts decrease as the balance turns positive")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: replay [flags] capture-file")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	replay, err := receiver.OpenReplay(flag.Arg(0), *realtime)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := receiver.OpenDatabase(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	if err := geometry.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	dr := receiver.NewDataRecorder(db, *clockID)
+	defer dr.Close()
+	clockConfig := receiver.DefaultClockConfig()
+	clockConfig.Geometry = geometry
+	clockConfig.NominalPeriod = *nominal
+	dr.SetConfig(clockConfig)
+
+	statusChan := make(chan receiver.StatusMessage)
+	readings := make(chan receiver.Reading)
+
+	serialReader := receiver.NewSerialReader(replay, statusChan)
+	serialReader.SetClock(replay.Now)
+	go serialReader.StartReading(readings)
+
+	count := 0
+	for done := false; !done; {
+		select {
+		case reading := <-readings:
+			dr.AddReading(reading, *tare)
+			count++
+		case status := <-statusChan:
+			if status.Status != receiver.StatusConnected {
+				log.Printf("%s %s", status.Status, status.Error)
+			}
+		case <-serialReader.Done():
+			done = true
+		}
+	}
+
+	cycles, err := dr.GetHistoricalData(0, math.MaxInt64)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Replayed %d readings, %d cycle records in %s", count, len(cycles), *dbPath)
+
+	stats := serialReader.Stats().Snapshot()
+	log.Printf("%d bytes, %d frames, %d checksum failures, %d resyncs, %d overflow markers, %d timestamp wraps",
+		stats.BytesReceived, stats.Frames, stats.ChecksumFailures, stats.Resyncs, stats.OverflowMarkers, stats.TimestampWraps)
+}
@@ -1,10 +1,62 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"log"
 	"receiver"
 )
 
 func main() {
-	server := receiver.NewServer()
+	config := receiver.DefaultConfig()
+	flag.StringVar(&config.DBPath, "db", config.DBPath, "SQLite database for cycle records")
+	flag.StringVar(&config.CapturePath, "capture", "", "append raw encoder bytes to this capture file")
+	flag.DurationVar(&config.TraceRetention, "trace-retention", config.TraceRetention, "how long to keep raw step events, 0 to not record them")
+	flag.DurationVar(&config.ReadingsRetention, "readings-retention", config.ReadingsRetention, "how long to keep cycle records, 0 for forever")
+	flag.DurationVar(&config.RollupRetention, "rollup-retention", config.RollupRetention, "how long to keep minute, hour and day rollups, 0 for forever")
+	flag.DurationVar(&config.SensorMaxAge, "sensor-max-age", config.SensorMaxAge, "oldest sensor reading recorded with a cycle")
+	flag.DurationVar(&config.ReconnectMaxDelay, "reconnect-max", config.ReconnectMaxDelay, "longest wait between reconnection attempts")
+	replay := flag.String("replay", "", "replay a capture file instead of waiting for a serial connection")
+	realtime := flag.Bool("realtime", true, "pace replay at the original speed")
+	simulate := flag.Bool("simulate", false, "connect to the built-in balance wheel simulator at startup")
+	dryRun := flag.Bool("migrate-dry-run", false, "list the schema migrations the database needs, and exit without applying them")
+	vacuum := flag.Bool("vacuum", false, "convert the database to incremental vacuum, so pruning can shrink it, and exit")
+	clockID := flag.String("clock", receiver.DefaultClockID, "clock to use for -replay or -simulate")
+	flag.Parse()
+
+	if *dryRun {
+		pending, err := receiver.PendingMigrations(config.DBPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(pending) == 0 {
+			fmt.Println("Database schema is up to date")
+		}
+		for _, m := range pending {
+			fmt.Printf("%d: %s\n", m.Version, m.Description)
+		}
+		return
+	}
+
+	if *vacuum {
+		db, err := receiver.OpenDatabase(config.DBPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		if err := receiver.EnableIncrementalVacuum(db); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	server := receiver.NewServer(config)
+	if *replay != "" {
+		if err := server.Clock(*clockID).StartReplay(*replay, *realtime); err != nil {
+			log.Fatal(err)
+		}
+	} else if *simulate {
+		go server.Clock(*clockID).Connect(receiver.TransportConfig{Type: receiver.TransportSimulator})
+	}
 	server.Start()
 }
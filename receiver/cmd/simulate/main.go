@@ -0,0 +1,172 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"receiver"
+	"slices"
+)
+
+// simulate runs the balance wheel simulator through the analysis pipeline
+// as fast as possible and compares the results with the ground truth.
+func main() {
+	config := receiver.DefaultSimulatorConfig()
+	flag.Float64Var(&config.Period, "period", config.Period, "oscillation period in seconds")
+	flag.Float64Var(&config.Amplitude, "amplitude", config.Amplitude, "peak-to-peak amplitude in degrees")
+	flag.Float64Var(&config.Q, "q", config.Q, "quality factor")
+	flag.Float64Var(&config.Impulse, "impulse", config.Impulse, "degrees added per beat, 0 for steady amplitude")
+	flag.Float64Var(&config.LiftAngle, "lift", config.LiftAngle, "lift angle in degrees")
+	flag.Float64Var(&config.ImpulseNoise, "impulse-noise", config.ImpulseNoise, "standard deviation of each impulse as a fraction of it")
+	flag.Float64Var(&config.DegreesPerStep, "resolution", config.DegreesPerStep, "encoder degrees per step")
+	flag.Float64Var(&config.BeatError, "beat-error", config.BeatError, "beat error in milliseconds")
+	flag.Float64Var(&config.Jitter, "jitter", config.Jitter, "timestamp jitter in microseconds")
+	flag.Float64Var(&config.DropRate, "drop", config.DropRate, "fraction of frames dropped")
+	flag.Float64Var(&config.OverflowRate, "overflow", config.OverflowRate, "fraction of frames replaced by overflow markers")
+	flag.IntVar(&config.Protocol, "protocol", config.Protocol, "frame protocol version")
+	flag.Float64Var(&config.Duration, "duration", 600, "simulated seconds")
+	flag.Int64Var(&config.Seed, "seed", config.Seed, "random seed")
+	dbPath := flag.String("db", "simulate.db", "SQLite database to write cycle records to")
+	clockID := flag.String("clock", receiver.DefaultClockID, "clock ID to record under")
+	nominal := flag.Float64("nominal", 0, "nominal period in seconds for rate, if not the simulated period")
+	flag.Parse()
+	config.Realtime = false
+
+	sim := receiver.NewSimulator(config)
+	db, err := receiver.OpenDatabase(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	dr := receiver.NewDataRecorder(db, *clockID)
+	defer dr.Close()
+	clockConfig := receiver.DefaultClockConfig()
+	clockConfig.Geometry = receiver.EncoderGeometry{
+		CountsPerRevolution: int(math.Round(360 / config.DegreesPerStep)),
+		GearRatio:           1,
+	}
+	clockConfig.NominalPeriod = *nominal
+	if clockConfig.NominalPeriod == 0 {
+		clockConfig.NominalPeriod = config.Period
+	}
+	dr.SetConfig(clockConfig)
+
+	statusChan := make(chan receiver.StatusMessage)
+	readings := make(chan receiver.Reading)
+
+	serialReader := receiver.NewSerialReader(sim, statusChan)
+	serialReader.SetClock(sim.Now)
+	sim.TrackCycles()
+	go serialReader.StartReading(readings)
+
+	startCount := sim.Truth().StartCount
+	var first, last uint64
+	for done := false; !done; {
+		select {
+		case reading := <-readings:
+			if first == 0 {
+				first = reading.TotalMicros
+				// Set the dial as the simulation starts
+				if err := dr.SyncDial(int64(first) + reading.ClockOffset); err != nil {
+					log.Fatal(err)
+				}
+			}
+			// Count from the encoder's zero rather than from where the
+			// wheel started, so there's nothing to re-zero at the start
+			reading.Count += startCount
+			if reading.TotalMicros == first {
+				reading.PositionUncertain = false
+			}
+			last = reading.TotalMicros
+			dr.AddReading(reading, 0)
+		case status := <-statusChan:
+			if status.Status == receiver.StatusSequenceGap {
+				log.Printf("%s %s", status.Status, status.Error)
+			}
+		case <-serialReader.Done():
+			done = true
+		}
+	}
+
+	cycles, err := dr.GetHistoricalData(int64(first), int64(last))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(cycles) == 0 {
+		log.Fatal("No cycles recorded")
+	}
+
+	summary, err := dr.GetSummary(int64(first), int64(last))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The truth changes from swing to swing as the amplitude settles and
+	// the impulses vary, so compare it with the same swings as the summary
+	totals := trueCycleMeans(sim.Cycles(), cycles)
+	truth := sim.Truth()
+	truth.Period = totals.Period
+	truth.Amplitude = totals.Amplitude
+	truth.BeatError = totals.BeatError
+	truth.Impulse = totals.Impulse
+	fmt.Printf("cycles:    %d (%d steps, %d dropped, %d overflows)\n", len(cycles), truth.Steps, truth.Dropped, truth.Overflows)
+	fmt.Printf("period:    truth %.6f s, measured %.6f s ± %.6f, error %+.1f ppm\n",
+		truth.Period, summary.Period.Mean, summary.Period.StdDev, (summary.Period.Mean/truth.Period-1)*1e6)
+	fmt.Printf("amplitude: truth %.3f°, measured %.3f° ± %.3f, error %+.3f°\n",
+		truth.Amplitude, summary.Amplitude.Mean, summary.Amplitude.StdDev, summary.Amplitude.Mean-truth.Amplitude)
+	fmt.Printf("beat:      truth %.3f ms, measured %.3f ms ± %.3f, error %+.3f ms\n",
+		truth.BeatError, summary.BeatError.Mean, summary.BeatError.StdDev, summary.BeatError.Mean-truth.BeatError)
+	fmt.Printf("rate:      truth %+.3f s/day, measured %+.3f s/day ± %.3f\n",
+		(clockConfig.NominalPeriod/truth.Period-1)*86400, summary.Rate.Mean, summary.Rate.StdDev)
+	fmt.Printf("fit:       period %.6f s ± %.6f, amplitude %.3f° ± %.3f, beat %.3f ms ± %.3f, residual %.3f° (%d of %d cycles)\n",
+		summary.FitPeriod.Mean, summary.FitPeriod.StdDev, summary.FitAmplitude.Mean, summary.FitAmplitude.StdDev,
+		summary.FitBeatError.Mean, summary.FitBeatError.StdDev, summary.FitResidual.Mean, summary.FitPeriod.Count, len(cycles))
+	if summary.VelocityAmplitude.Count > 0 {
+		fmt.Printf("velocity:  amplitude %.3f° ± %.3f from peak velocity, error %+.3f°\n",
+			summary.VelocityAmplitude.Mean, summary.VelocityAmplitude.StdDev, summary.VelocityAmplitude.Mean-truth.Amplitude)
+	}
+	if summary.QFactor.Count > 0 {
+		fmt.Printf("q:         truth %.1f, measured %.1f ± %.1f, impulse %.2f%% of swing energy\n",
+			config.Q, summary.QFactor.Mean, summary.QFactor.StdDev, summary.ImpulseFraction.Mean*100)
+	}
+	if summary.ImpulseMagnitude.Count > 0 {
+		fmt.Printf("impulse:   truth %.3f° over ±%.1f ms, measured %.3f° ± %.3f from %+.1f to %+.1f ms (%d of %d beats)\n",
+			truth.Impulse, truth.ImpulseDuration/2, summary.ImpulseMagnitude.Mean, summary.ImpulseMagnitude.StdDev,
+			summary.UnlockTime.Mean, summary.DropTime.Mean, summary.ImpulseMagnitude.Count, len(cycles))
+	}
+	if dial := dr.Dial(); dial.Error != nil {
+		elapsed := float64(dial.LastCrossing-dial.SyncTime) / 1e6
+		fmt.Printf("dial:      truth %+.3f s, measured %+.3f s after %.0f oscillations (%.0f estimated)\n",
+			elapsed*(clockConfig.NominalPeriod/truth.Period-1), *dial.Error, dial.Oscillations, dial.EstimatedOscillations)
+	}
+}
+
+// trueCycleMeans returns the mean ground truth over the simulated swings
+// ending nearest to each recorded cycle.
+func trueCycleMeans(truth []receiver.SimulatorCycle, cycles []receiver.HistoricalData) receiver.SimulatorCycle {
+	var mean receiver.SimulatorCycle
+	if len(truth) == 0 {
+		return mean
+	}
+	for _, cycle := range cycles {
+		t := int64(cycle.TotalMicros)
+		i, _ := slices.BinarySearchFunc(truth, t, func(c receiver.SimulatorCycle, t int64) int {
+			return cmp.Compare(c.Time, t)
+		})
+		if i == len(truth) || (i > 0 && t-truth[i-1].Time < truth[i].Time-t) {
+			i--
+		}
+		mean.Period += truth[i].Period
+		mean.Amplitude += truth[i].Amplitude
+		mean.BeatError += truth[i].BeatError
+		mean.Impulse += truth[i].Impulse
+	}
+	n := float64(len(cycles))
+	mean.Period /= n
+	mean.Amplitude /= n
+	mean.BeatError /= n
+	mean.Impulse /= n
+	return mean
+}
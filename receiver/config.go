@@ -0,0 +1,35 @@
+package receiver
+
+import "time"
+
+// Config holds the server's startup options.
+type Config struct {
+	DBPath      string // SQLite database for cycle records
+	CapturePath string // If set, raw encoder bytes are appended here while connected
+
+	// How long step events are kept in the database's raw trace; zero
+	// disables it
+	TraceRetention time.Duration
+
+	// How long cycle records and rollups are kept; zero keeps them forever
+	ReadingsRetention time.Duration
+	RollupRetention   time.Duration
+
+	// How far a sensor reading can be from a cycle and still be recorded
+	// with it
+	SensorMaxAge time.Duration
+
+	// Backoff bounds for reopening a failed encoder connection
+	ReconnectMinDelay time.Duration
+	ReconnectMaxDelay time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		DBPath:            "readings.db",
+		TraceRetention:    DefaultTraceRetention,
+		SensorMaxAge:      DefaultSensorMaxAge,
+		ReconnectMinDelay: time.Second,
+		ReconnectMaxDelay: time.Minute,
+	}
+}
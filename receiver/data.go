@@ -2,24 +2,69 @@ package receiver
 
 import (
 	"database/sql"
+	"fmt"
 	_ "github.com/mattn/go-sqlite3"
-	"math"
 	"log"
+	"math"
+	"sync"
+	"time"
 )
 
 type DataRecorder struct {
-	db                *sql.DB
-	readings          []Reading    // Circular buffer for recent readings
-	maxReadings       int          // Size of circular buffer
-	currentIndex      int          // Current position in circular buffer
-	lastPositivePeak  *Peak
-	lastNegativePeak  *Peak
-	lastZeroCrossing  *ZeroCrossing
-	lastBMP180        *BMP180Reading
-	lastBMP390        *BMP390Reading
-	lastSHT85         *SHT85Reading
+	mu                 sync.Mutex // Guards the analysis against config changes
+	db                 *sql.DB
+	clockID            string
+	geometry           EncoderGeometry
+	config             ClockConfig
+	readings           []Reading // Circular buffer for recent readings
+	maxReadings        int       // Size of circular buffer
+	currentIndex       int       // Current position in circular buffer
+	lastPositivePeak   *Peak
+	lastNegativePeak   *Peak
+	lastZeroCrossing   *ZeroCrossing
 	positiveHalfPeriod float64
 	negativeHalfPeriod float64
+
+	// Position tracking, see position.go
+	tareOffset        int
+	countCorrection   int // Steps added to every count to undo lost steps
+	positionUncertain bool
+	lastTurn          *turningPoint // The most recent turning point, nil if none usable
+	midpointRef       float64
+	haveMidpointRef   bool
+	rezeroMidpoints   []float64
+
+	// Least-squares swing fits, see swing_fit.go
+	swingSamples    []swingSample
+	lastPositiveFit *SwingFit
+	lastNegativeFit *SwingFit
+
+	// Escapement impulse detection, see impulse.go
+	lastImpulse     *ImpulseFit
+	impulseTail     []swingSample // End of the last swing
+	impulseCrossing float64       // Crossing at the end of the last swing
+
+	// Velocity and acceleration, see kinematics.go
+	kinematics    kinematicsFilter
+	passageSpeed  float64   // Top speed since the last turning point
+	passageSpeeds []float64 // Top speeds of the last two passages through zero
+
+	// Raw step events, see trace.go
+	traceEvents    []traceEvent // Waiting to be written as a chunk
+	traceRetention time.Duration
+
+	// Environmental sensors, see sensors.go
+	bmp180       sensorHistory
+	bmp390       sensorHistory
+	sht85        sensorHistory
+	sensorMaxAge time.Duration
+	unwritten    []HistoricalData // Cycles waiting for the sensors to report after them
+
+	rate   rateTracker
+	energy energyTracker
+	dial   *dial
+
+	writer *dbWriter // Applies writes in the background, nil to write straight away
 }
 
 type Peak struct {
@@ -28,67 +73,177 @@ type Peak struct {
 }
 
 type ZeroCrossing struct {
-	Time  int64
+	Time            int64
 	IsPositiveGoing bool
 }
 
 // Add this new type to hold historical data
 type HistoricalData struct {
-	TotalMicros      uint64  `json:"total_micros"`
-	TimestampDrift   int64   `json:"timestamp_drift"`
-	Amplitude        float64 `json:"amplitude"`
-	Period           float64 `json:"period"`
-	BMP180Temperature float64 `json:"bmp180_temperature"`
-	BMP180Pressure   float64 `json:"bmp180_pressure"`
-	BMP390Temperature float64 `json:"bmp390_temperature"`
-	BMP390Pressure   float64 `json:"bmp390_pressure"`
-	SHT85Temperature float64 `json:"sht85_temperature"`
-	SHT85Humidity    float64 `json:"sht85_humidity"`
+	TotalMicros      uint64   `json:"total_micros"`
+	TimestampDrift   int64    `json:"timestamp_drift"`
+	Amplitude        float64  `json:"amplitude"`
+	Period           float64  `json:"period"`
+	BeatError        float64  `json:"beat_error"`        // Milliseconds
+	Rate             *float64 `json:"rate"`              // Seconds per day fast, null without a nominal period
+	RateSmoothed     *float64 `json:"rate_smoothed"`     // Rate averaged over the clock's rate_smoothing time
+	AccumulatedError *float64 `json:"accumulated_error"` // Seconds the dial is ahead of host time since it was set, null until set
+	FitPeriod        *float64 `json:"fit_period"`        // As Period, from least-squares swing fits; null if a fit failed
+	FitAmplitude     *float64 `json:"fit_amplitude"`
+	FitBeatError     *float64 `json:"fit_beat_error"`
+	FitResidual      *float64 `json:"fit_residual"`     // RMS residual of the fits in degrees
+	QFactor          *float64 `json:"q_factor"`         // Null until the amplitude has varied enough to fit
+	ImpulseFraction  *float64 `json:"impulse_fraction"` // Fraction of each swing's energy supplied by the escapement
+	ImpulseEnergy    *float64 `json:"impulse_energy"`   // Microjoules per impulse, null without the clock's moment_of_inertia
+	// The escapement impulse at the start of the half-swing this beat ends,
+	// timed in milliseconds from its zero crossing. Null if none was found.
+	UnlockTime        *float64 `json:"unlock_time"`
+	DropTime          *float64 `json:"drop_time"`
+	ImpulseMagnitude  *float64 `json:"impulse_magnitude"`  // Degrees of amplitude added
+	PeakVelocity      *float64 `json:"peak_velocity"`      // Degrees per second through zero, averaged over the cycle
+	VelocityAmplitude *float64 `json:"velocity_amplitude"` // Amplitude implied by the peak velocity and period
+	// Sensor values interpolated to the cycle's time, null if the sensor
+	// hadn't reported within the maximum age. The ages are the seconds
+	// since each sensor's last reading before the cycle.
+	BMP180Temperature *float64 `json:"bmp180_temperature"`
+	BMP180Pressure    *float64 `json:"bmp180_pressure"`
+	BMP180Age         *float64 `json:"bmp180_age"`
+	BMP390Temperature *float64 `json:"bmp390_temperature"`
+	BMP390Pressure    *float64 `json:"bmp390_pressure"`
+	BMP390Age         *float64 `json:"bmp390_age"`
+	SHT85Temperature  *float64 `json:"sht85_temperature"`
+	SHT85Humidity     *float64 `json:"sht85_humidity"`
+	SHT85Age          *float64 `json:"sht85_age"`
+	ClockOffset       int64    `json:"clock_offset"`
+	ClockSkewPPM      float64  `json:"clock_skew_ppm"`
+	PositionUncertain bool     `json:"position_uncertain"`
+	LostSteps         uint64   `json:"lost_steps"`
 }
 
-const STEPS_PER_DEGREE = 2
-
-func NewDataRecorder() (*DataRecorder, error) {
-	db, err := sql.Open("sqlite3", "readings.db")
+// OpenDatabase opens the SQLite database holding every clock's records,
+// creating or upgrading its tables as needed.
+func OpenDatabase(dbPath string) (*sql.DB, error) {
+	// Writers wait for each other rather than failing, as pruning runs
+	// alongside the recorders. With write-ahead logging, queries don't
+	// wait for writes, and a commit only has to sync the log; a power cut
+	// may lose the last few commits, but can't corrupt the database.
+	db, err := sql.Open("sqlite3", dbPath+"?_auto_vacuum=incremental&_busy_timeout=5000&_journal_mode=WAL&_synchronous=NORMAL")
 	if err != nil {
 		return nil, err
 	}
+	if _, err := MigrateDatabase(db, false); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if mode, err := autoVacuumMode(db); err == nil && mode != autoVacuumIncremental {
+		log.Println("Database isn't in incremental vacuum mode, so pruning won't shrink the file until it's converted with -vacuum")
+	}
 
-	// Create table if it doesn't exist
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS readings (
-			total_micros INTEGER PRIMARY KEY,
-			timestamp_drift INTEGER,
-			amplitude REAL,
-			period REAL,
-			bmp180_temperature REAL,
-			bmp180_pressure REAL,
-			bmp390_temperature REAL,
-			bmp390_pressure REAL,
-			sht85_temperature REAL,
-			sht85_humidity REAL
-		)
-	`)
+	return db, nil
+}
+
+// NewDataRecorder analyses one clock's readings and records its cycles in
+// db under clockID.
+func NewDataRecorder(db *sql.DB, clockID string) *DataRecorder {
+	d, err := loadDial(db, clockID)
 	if err != nil {
-		return nil, err
+		log.Printf("Clock %s: failed to load dial, starting a new count: %v", clockID, err)
 	}
 
 	return &DataRecorder{
-		db:          db,
-		readings:    make([]Reading, 1000), // Keep last 1000 readings for analysis
-		maxReadings: 1000,
-	}, nil
+		db:             db,
+		clockID:        clockID,
+		geometry:       DefaultEncoderGeometry(),
+		config:         DefaultClockConfig(),
+		readings:       make([]Reading, 1000), // Keep last 1000 readings for analysis
+		maxReadings:    1000,
+		dial:           d,
+		traceRetention: DefaultTraceRetention,
+		sensorMaxAge:   DefaultSensorMaxAge,
+	}
 }
 
-func (dr *DataRecorder) Close() error {
-	return dr.db.Close()
+// SetConfig applies the clock's settings. If the geometry changes, peaks
+// and zero crossings found under the old geometry are discarded.
+func (dr *DataRecorder) SetConfig(config ClockConfig) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	if config.Period() != dr.config.Period() {
+		dr.rate.reset()
+	}
+	if config.KinematicsWindow != dr.config.KinematicsWindow || config.KinematicsOrder != dr.config.KinematicsOrder {
+		dr.resetKinematics()
+	}
+	dr.config = config
+	if config.Geometry == dr.geometry {
+		return
+	}
+
+	dr.geometry = config.Geometry
+	dr.lastPositivePeak = nil
+	dr.lastNegativePeak = nil
+	dr.lastZeroCrossing = nil
+	dr.positiveHalfPeriod = 0
+	dr.negativeHalfPeriod = 0
+	dr.swingSamples = nil
+	dr.lastPositiveFit = nil
+	dr.lastNegativeFit = nil
+	dr.energy.reset()
+	dr.lastImpulse = nil
+	dr.impulseTail = nil
+	dr.resetKinematics()
+	dr.haveMidpointRef = false
+	dr.lastTurn = nil
 }
 
-// AddReading processes a new reading and updates peaks/crossings
-func (dr *DataRecorder) AddReading(reading Reading, tareOffset int) {
+// ClockIDs returns the IDs of all clocks with records or config in db.
+func ClockIDs(db dbExecutor) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT clock_id FROM readings
+		UNION
+		SELECT clock_id FROM clock_config
+		ORDER BY clock_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// AddReading processes a new reading and updates peaks/crossings. It
+// returns the reading with any position correction applied, for display,
+// the smoothed kinematics once enough edges have been seen, and the cycle
+// record if the reading completed a beat. The record's sensor values are
+// null, as they're only known once the sensors have reported after it.
+func (dr *DataRecorder) AddReading(reading Reading, tareOffset int) (Reading, *Kinematics, *HistoricalData) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	if tareOffset != dr.tareOffset {
+		dr.setTare(tareOffset)
+	}
+	if reading.PositionUncertain {
+		dr.positionLost()
+	}
+	reading.Count += dr.countCorrection
+	reading.PositionUncertain = dr.positionUncertain
+	reading.Degrees = dr.geometry.Degrees(float64(reading.Count))
+	corrected := reading
+
 	// Store reading in circular buffer
-	reading.Count -= tareOffset / STEPS_PER_DEGREE
+	reading.Count -= dr.geometry.Counts(float64(tareOffset))
 	dr.readings[dr.currentIndex] = reading
+	dr.addTraceEvent(corrected)
 	dr.currentIndex = (dr.currentIndex + 1) % dr.maxReadings
 
 	// Get previous reading for comparison
@@ -97,36 +252,63 @@ func (dr *DataRecorder) AddReading(reading Reading, tareOffset int) {
 
 	// Detect zero crossings and peaks
 	newCrossing := dr.detectZeroCrossings(reading, prevReading)
-	dr.detectPeaks()
+	sample := dr.edgeSample(reading, prevReading)
+	kinematics := dr.addKinematics(sample)
+	dr.addSwingSample(sample, reading, prevReading, newCrossing)
+	peak, turn := dr.detectPeaks()
+	if peak != 0 {
+		dr.addPeakAmplitude(peak)
+		dr.endPassage()
+	}
+	if turn != nil {
+		dr.trackPosition(*turn)
+	}
 
-	// If we just had a new zero crossing and have all the data, write to database
+	// If we just had a new zero crossing and have all the data, record a cycle
+	var cycle *HistoricalData
 	if newCrossing {
-		err := dr.writeToDatabase()
-		if err != nil {
-			log.Println("Error writing to database:", err)
+		if dr.lastZeroCrossing.IsPositiveGoing {
+			// The dial is compared with host time, so correct for the
+			// device clock's drift
+			hostMicros := dr.lastZeroCrossing.Time + reading.ClockOffset
+			dr.dial.oscillation(hostMicros, dr.estimatedPeriod(), dr.config.Period())
+			dr.saveDialIfDue()
 		}
-	}
-}
 
-func (dr *DataRecorder) UpdateBMP180(reading BMP180Reading) {
-	dr.lastBMP180 = &reading
-}
-
-func (dr *DataRecorder) UpdateBMP390(reading BMP390Reading) {
-	dr.lastBMP390 = &reading
-}
+		if cycle = dr.newCycle(); cycle != nil {
+			dr.unwritten = append(dr.unwritten, *cycle)
+		}
+	}
+	if len(dr.unwritten) > 0 {
+		dr.writeCycles(int64(reading.TotalMicros)+reading.ClockOffset, false)
+	}
 
-func (dr *DataRecorder) UpdateSHT85(reading SHT85Reading) {
-	dr.lastSHT85 = &reading
+	return corrected, kinematics, cycle
 }
 
 // detectZeroCrossings checks for zero crossings in the signal
 // Returns true if a new zero crossing was detected
 func (dr *DataRecorder) detectZeroCrossings(reading, prevReading Reading) bool {
+	if prevReading.TotalMicros == 0 {
+		return false // Nothing to compare the first reading with
+	}
+
 	// Convert counts to degrees
-	current := float64(reading.Count) * STEPS_PER_DEGREE
-	prev := float64(prevReading.Count) * STEPS_PER_DEGREE
+	current := dr.geometry.Degrees(float64(reading.Count))
+	prev := dr.geometry.Degrees(float64(prevReading.Count))
+
+	// The counts only say which side of zero the wheel is on. Interpolate
+	// between the angles at which the two counts were entered to find when
+	// it actually passed through zero, so that the quantization step
+	// doesn't bias one half period against the other.
+	up := reading.Count > prevReading.Count
+	edge := dr.geometry.EdgeDegrees(reading.Count, up)
+	prevEdge := dr.geometry.EdgeDegrees(prevReading.Count, up)
 	currentTime := int64(reading.TotalMicros)
+	if edge != prevEdge {
+		fraction := math.Max(0, math.Min(1, -prevEdge/(edge-prevEdge)))
+		currentTime = int64(prevReading.TotalMicros) + int64(fraction*float64(reading.TotalMicros-prevReading.TotalMicros))
+	}
 
 	// Require at least 100ms between zero crossings to avoid noise
 	if dr.lastZeroCrossing != nil && (currentTime-dr.lastZeroCrossing.Time) < 100000 {
@@ -152,8 +334,10 @@ func (dr *DataRecorder) detectZeroCrossings(reading, prevReading Reading) bool {
 	return false
 }
 
-// detectPeaks uses quadratic interpolation to find precise peak locations
-func (dr *DataRecorder) detectPeaks() {
+// detectPeaks uses quadratic interpolation to find precise peak locations.
+// Returns 1 or -1 if a new positive or negative peak was found, else 0,
+// along with any new turning point, whichever side of zero it's on.
+func (dr *DataRecorder) detectPeaks() (int, *turningPoint) {
 	// Check if we have at least 3 readings in total
 	numReadings := 0
 	for i := 0; i < dr.maxReadings; i++ {
@@ -162,7 +346,7 @@ func (dr *DataRecorder) detectPeaks() {
 		}
 	}
 	if numReadings < 3 {
-		return
+		return 0, nil
 	}
 
 	// Get the last three points
@@ -170,28 +354,50 @@ func (dr *DataRecorder) detectPeaks() {
 	idx2 := (dr.currentIndex - 2 + dr.maxReadings) % dr.maxReadings
 	idx3 := (dr.currentIndex - 1 + dr.maxReadings) % dr.maxReadings
 
-	p1 := float64(dr.readings[idx1].Count) * 2
-	p2 := float64(dr.readings[idx2].Count) * 2
-	p3 := float64(dr.readings[idx3].Count) * 2
+	c1 := dr.readings[idx1].Count
+	c2 := dr.readings[idx2].Count
+	c3 := dr.readings[idx3].Count
+	p1 := dr.geometry.Degrees(float64(c1))
+	p2 := dr.geometry.Degrees(float64(c2))
+	p3 := dr.geometry.Degrees(float64(c3))
+
+	// For interpolation, use the angle at which each count was entered
+	// rather than the count itself. The first point is taken to be moving
+	// the same way as the second.
+	e1 := dr.geometry.EdgeDegrees(c1, c2 > c1)
+	e2 := dr.geometry.EdgeDegrees(c2, c2 > c1)
+	e3 := dr.geometry.EdgeDegrees(c3, c3 > c2)
 
 	t1 := float64(dr.readings[idx1].TotalMicros)
 	t2 := float64(dr.readings[idx2].TotalMicros)
 	t3 := float64(dr.readings[idx3].TotalMicros)
 
+	var direction int
+	switch {
+	case p2 > p1 && p2 > p3:
+		direction = 1
+	case p2 < p1 && p2 < p3:
+		direction = -1
+	default:
+		return 0, nil
+	}
+	peak := dr.interpolatePeak(e1, e2, e3, t1, t2, t3)
+	if peak == nil {
+		return 0, nil
+	}
+	turn := &turningPoint{Direction: direction, Position: peak.Position}
+
 	// Detect positive peak
-	if p2 > p1 && p2 > p3 && p2 > 0 {
-		// Add 2 degrees to p3 to account for quantization
-		if peak := dr.interpolatePeak(p1, p2, p3+2, t1, t2, t3); peak != nil {
-			dr.lastPositivePeak = peak
-		}
+	if direction > 0 && p2 > 0 {
+		dr.lastPositivePeak = peak
+		return 1, turn
 	}
 	// Detect negative peak
-	if p2 < p1 && p2 < p3 && p2 < 0 {
-		// Add 2 degrees to p1 and p2 to account for quantization
-		if peak := dr.interpolatePeak(p1+2, p2+2, p3, t1, t2, t3); peak != nil {
-			dr.lastNegativePeak = peak
-		}
+	if direction < 0 && p2 < 0 {
+		dr.lastNegativePeak = peak
+		return -1, turn
 	}
+	return 0, turn
 }
 
 // interpolatePeak performs quadratic interpolation to find precise peak location
@@ -203,7 +409,7 @@ func (dr *DataRecorder) interpolatePeak(p1, p2, p3, t1, t2, t3 float64) *Peak {
 	x3 := t3 - t0
 
 	// Solve quadratic equation y = ax² + bx + c
-	denom := (x1-x2)*(x1-x3)*(x2-x3)
+	denom := (x1 - x2) * (x1 - x3) * (x2 - x3)
 	a := (x3*(p2-p1) + x2*(p1-p3) + x1*(p3-p2)) / denom
 	b := (x3*x3*(p1-p2) + x2*x2*(p3-p1) + x1*x1*(p2-p3)) / denom
 
@@ -215,8 +421,8 @@ func (dr *DataRecorder) interpolatePeak(p1, p2, p3, t1, t2, t3 float64) *Peak {
 	pPeak := a*xPeak*xPeak + b*xPeak + p2
 
 	// Only return result if peak is within the time interval
-	// and if the interpolated peak is within 4 units of the middle value
-	if tPeak >= t1 && tPeak <= t3 && math.Abs(pPeak-p2) <= 4 {
+	// and if the interpolated peak is within two counts of the middle value
+	if tPeak >= t1 && tPeak <= t3 && math.Abs(pPeak-p2) <= 2*dr.geometry.DegreesPerCount() {
 		return &Peak{
 			Time:     int64(tPeak),
 			Position: pPeak,
@@ -226,7 +432,10 @@ func (dr *DataRecorder) interpolatePeak(p1, p2, p3, t1, t2, t3 float64) *Peak {
 	return nil
 }
 
-func (dr *DataRecorder) writeToDatabase() error {
+// newCycle returns the record of the cycle ending at the latest zero
+// crossing, or nil until a full cycle has been seen. Its sensor values are
+// left for writeCycles to fill in.
+func (dr *DataRecorder) newCycle() *HistoricalData {
 	// Check if we have all the data we need
 	if dr.lastZeroCrossing == nil ||
 		dr.lastPositivePeak == nil ||
@@ -236,51 +445,151 @@ func (dr *DataRecorder) writeToDatabase() error {
 		return nil
 	}
 
-	period := dr.positiveHalfPeriod + dr.negativeHalfPeriod
-	amplitude := dr.lastPositivePeak.Position - dr.lastNegativePeak.Position
-
-	var bmp180Temp, bmp180Pressure, bmp390Temp, bmp390Pressure, shtTemp, shtHumidity float64
-	if dr.lastBMP180 != nil {
-		bmp180Temp = dr.lastBMP180.Temperature
-		bmp180Pressure = dr.lastBMP180.Pressure
+	latest := dr.readings[(dr.currentIndex-1+dr.maxReadings)%dr.maxReadings]
+	cycle := HistoricalData{
+		TotalMicros:    latest.TotalMicros,
+		TimestampDrift: latest.TimestampDrift,
+		Period:         dr.positiveHalfPeriod + dr.negativeHalfPeriod,
+		Amplitude:      dr.lastPositivePeak.Position - dr.lastNegativePeak.Position,
+		// Half the difference between the two beats, as a timegrapher shows it
+		BeatError:         (dr.positiveHalfPeriod - dr.negativeHalfPeriod) / 2 * 1000,
+		ClockOffset:       latest.ClockOffset,
+		ClockSkewPPM:      latest.SkewPPM,
+		PositionUncertain: dr.positionUncertain,
+		LostSteps:         latest.LostSteps,
 	}
-	if dr.lastBMP390 != nil {
-		bmp390Temp = dr.lastBMP390.Temperature
-		bmp390Pressure = dr.lastBMP390.Pressure
-	}
-	if dr.lastSHT85 != nil {
-		shtTemp = dr.lastSHT85.Temperature
-		shtHumidity = dr.lastSHT85.Humidity
+	dr.addSwingFits(&cycle)
+	dr.addEnergy(&cycle)
+	dr.addImpulse(&cycle)
+	dr.addPeakVelocity(&cycle)
+	dr.rate.update(&cycle, dr.config)
+	if e, ok := dr.dial.errorSeconds(dr.config.Period()); ok {
+		cycle.AccumulatedError = &e
 	}
+	return &cycle
+}
 
-	_, err := dr.db.Exec(`
-		INSERT INTO readings (
-			total_micros,
-			timestamp_drift,
-			amplitude,
-			period,
-			bmp180_temperature,
-			bmp180_pressure,
-			bmp390_temperature,
-			bmp390_pressure,
-			sht85_temperature,
-			sht85_humidity
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		dr.readings[(dr.currentIndex-1+dr.maxReadings)%dr.maxReadings].TotalMicros,
-		dr.readings[(dr.currentIndex-1+dr.maxReadings)%dr.maxReadings].TimestampDrift,
-		amplitude,
-		period,
-		bmp180Temp,
-		bmp180Pressure,
-		bmp390Temp,
-		bmp390Pressure,
-		shtTemp,
-		shtHumidity,
-	)
+// writeToDatabase records a cycle, and adds it to the rollups.
+func (dr *DataRecorder) writeToDatabase(cycle HistoricalData) {
+	// The cycle and the rollups it's added to are written together
+	clockID := dr.clockID
+	dr.write("cycle", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT INTO readings (
+				clock_id,
+				total_micros,
+				timestamp_drift,
+				amplitude,
+				period,
+				beat_error,
+				rate,
+				rate_smoothed,
+				accumulated_error,
+				fit_period,
+				fit_amplitude,
+				fit_beat_error,
+				fit_residual,
+				q_factor,
+				impulse_fraction,
+				impulse_energy,
+				unlock_time,
+				drop_time,
+				impulse_magnitude,
+				peak_velocity,
+				velocity_amplitude,
+				bmp180_temperature,
+				bmp180_pressure,
+				bmp390_temperature,
+				bmp390_pressure,
+				sht85_temperature,
+				sht85_humidity,
+				bmp180_age,
+				bmp390_age,
+				sht85_age,
+				clock_offset,
+				clock_skew_ppm,
+				position_uncertain,
+				lost_steps
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			clockID,
+			cycle.TotalMicros,
+			cycle.TimestampDrift,
+			cycle.Amplitude,
+			cycle.Period,
+			cycle.BeatError,
+			cycle.Rate,
+			cycle.RateSmoothed,
+			cycle.AccumulatedError,
+			cycle.FitPeriod,
+			cycle.FitAmplitude,
+			cycle.FitBeatError,
+			cycle.FitResidual,
+			cycle.QFactor,
+			cycle.ImpulseFraction,
+			cycle.ImpulseEnergy,
+			cycle.UnlockTime,
+			cycle.DropTime,
+			cycle.ImpulseMagnitude,
+			cycle.PeakVelocity,
+			cycle.VelocityAmplitude,
+			cycle.BMP180Temperature,
+			cycle.BMP180Pressure,
+			cycle.BMP390Temperature,
+			cycle.BMP390Pressure,
+			cycle.SHT85Temperature,
+			cycle.SHT85Humidity,
+			cycle.BMP180Age,
+			cycle.BMP390Age,
+			cycle.SHT85Age,
+			cycle.ClockOffset,
+			cycle.ClockSkewPPM,
+			cycle.PositionUncertain,
+			cycle.LostSteps,
+		)
+		if err != nil {
+			return err
+		}
+		return addToRollups(tx, clockID, &cycle)
+	})
+}
+
+// setWriter has the recorder's writes applied by w.
+func (dr *DataRecorder) setWriter(w *dbWriter) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	dr.writer = w
+}
 
+// write applies a change to the database, through the writer if there is
+// one. Errors are returned only from changes written straight away; the
+// writer logs its own.
+func (dr *DataRecorder) write(what string, apply func(tx *sql.Tx) error) error {
+	failure := fmt.Sprintf("Clock %s: failed to write %s", dr.clockID, what)
+	if dr.writer != nil && dr.writer.write(failure, apply) {
+		return nil
+	}
+	err := writeNow(dr.db, apply)
+	if err != nil {
+		log.Printf("%s: %v", failure, err)
+	}
 	return err
 }
 
+// ReadingsSpan returns the times of the clock's oldest and newest cycle
+// records. ok is false if there are none.
+func (dr *DataRecorder) ReadingsSpan() (oldest, newest int64, ok bool, err error) {
+	return readingsSpan(dr.db, dr.clockID)
+}
+
+func readingsSpan(db dbExecutor, clockID string) (oldest, newest int64, ok bool, err error) {
+	var min, max sql.NullInt64
+	err = db.QueryRow("SELECT MIN(total_micros), MAX(total_micros) FROM readings WHERE clock_id = ?", clockID).Scan(&min, &max)
+	if err != nil || !min.Valid {
+		return 0, 0, false, err
+	}
+	return min.Int64, max.Int64, true, nil
+}
+
 func (dr *DataRecorder) GetHistoricalData(startTime, endTime int64) ([]HistoricalData, error) {
 	rows, err := dr.db.Query(`
 		SELECT 
@@ -288,16 +597,39 @@ func (dr *DataRecorder) GetHistoricalData(startTime, endTime int64) ([]Historica
 			timestamp_drift,
 			amplitude,
 			period,
+			COALESCE(beat_error, 0),
+			rate,
+			rate_smoothed,
+			accumulated_error,
+			fit_period,
+			fit_amplitude,
+			fit_beat_error,
+			fit_residual,
+			q_factor,
+			impulse_fraction,
+			impulse_energy,
+			unlock_time,
+			drop_time,
+			impulse_magnitude,
+			peak_velocity,
+			velocity_amplitude,
 			bmp180_temperature,
 			bmp180_pressure,
 			bmp390_temperature,
 			bmp390_pressure,
 			sht85_temperature,
-			sht85_humidity
+			sht85_humidity,
+			bmp180_age,
+			bmp390_age,
+			sht85_age,
+			COALESCE(clock_offset, 0),
+			COALESCE(clock_skew_ppm, 0),
+			COALESCE(position_uncertain, 0),
+			COALESCE(lost_steps, 0)
 		FROM readings
-		WHERE total_micros BETWEEN ? AND ?
+		WHERE clock_id = ? AND total_micros BETWEEN ? AND ?
 		ORDER BY total_micros ASC
-	`, startTime, endTime)
+	`, dr.clockID, startTime, endTime)
 	if err != nil {
 		return nil, err
 	}
@@ -312,12 +644,35 @@ func (dr *DataRecorder) GetHistoricalData(startTime, endTime int64) ([]Historica
 			&point.TimestampDrift,
 			&point.Amplitude,
 			&point.Period,
+			&point.BeatError,
+			&point.Rate,
+			&point.RateSmoothed,
+			&point.AccumulatedError,
+			&point.FitPeriod,
+			&point.FitAmplitude,
+			&point.FitBeatError,
+			&point.FitResidual,
+			&point.QFactor,
+			&point.ImpulseFraction,
+			&point.ImpulseEnergy,
+			&point.UnlockTime,
+			&point.DropTime,
+			&point.ImpulseMagnitude,
+			&point.PeakVelocity,
+			&point.VelocityAmplitude,
 			&point.BMP180Temperature,
 			&point.BMP180Pressure,
 			&point.BMP390Temperature,
 			&point.BMP390Pressure,
 			&point.SHT85Temperature,
 			&point.SHT85Humidity,
+			&point.BMP180Age,
+			&point.BMP390Age,
+			&point.SHT85Age,
+			&point.ClockOffset,
+			&point.ClockSkewPPM,
+			&point.PositionUncertain,
+			&point.LostSteps,
 		)
 		if err != nil {
 			return nil, err
@@ -330,4 +685,80 @@ func (dr *DataRecorder) GetHistoricalData(startTime, endTime int64) ([]Historica
 	}
 
 	return results, nil
-}
\ No newline at end of file
+}
+
+// ColumnSummary describes the spread of one column over a time range.
+type ColumnSummary struct {
+	Count  int     `json:"count"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"std_dev"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+}
+
+// Summary describes a clock's performance over a time range.
+type Summary struct {
+	Start     int64         `json:"start"`
+	End       int64         `json:"end"`
+	Period    ColumnSummary `json:"period"`
+	Amplitude ColumnSummary `json:"amplitude"`
+	BeatError ColumnSummary `json:"beat_error"`
+	Rate      ColumnSummary `json:"rate"`
+
+	// The same from the least-squares swing fits, for comparison
+	FitPeriod    ColumnSummary `json:"fit_period"`
+	FitAmplitude ColumnSummary `json:"fit_amplitude"`
+	FitBeatError ColumnSummary `json:"fit_beat_error"`
+	FitResidual  ColumnSummary `json:"fit_residual"`
+
+	QFactor         ColumnSummary `json:"q_factor"`
+	ImpulseFraction ColumnSummary `json:"impulse_fraction"`
+
+	UnlockTime       ColumnSummary `json:"unlock_time"`
+	DropTime         ColumnSummary `json:"drop_time"`
+	ImpulseMagnitude ColumnSummary `json:"impulse_magnitude"`
+
+	VelocityAmplitude ColumnSummary `json:"velocity_amplitude"`
+}
+
+// GetSummary summarizes the cycles recorded between startTime and endTime.
+func (dr *DataRecorder) GetSummary(startTime, endTime int64) (Summary, error) {
+	summary := Summary{Start: startTime, End: endTime}
+	for _, column := range []struct {
+		name    string
+		summary *ColumnSummary
+	}{
+		{"period", &summary.Period},
+		{"amplitude", &summary.Amplitude},
+		{"beat_error", &summary.BeatError},
+		{"rate", &summary.Rate},
+		{"fit_period", &summary.FitPeriod},
+		{"fit_amplitude", &summary.FitAmplitude},
+		{"fit_beat_error", &summary.FitBeatError},
+		{"fit_residual", &summary.FitResidual},
+		{"q_factor", &summary.QFactor},
+		{"impulse_fraction", &summary.ImpulseFraction},
+		{"unlock_time", &summary.UnlockTime},
+		{"drop_time", &summary.DropTime},
+		{"impulse_magnitude", &summary.ImpulseMagnitude},
+		{"velocity_amplitude", &summary.VelocityAmplitude},
+	} {
+		var mean, meanSq, min, max sql.NullFloat64
+		err := dr.db.QueryRow(fmt.Sprintf(`
+			SELECT COUNT(%[1]s), AVG(%[1]s), AVG(%[1]s * %[1]s), MIN(%[1]s), MAX(%[1]s)
+			FROM readings
+			WHERE clock_id = ? AND total_micros BETWEEN ? AND ?
+		`, column.name), dr.clockID, startTime, endTime).Scan(&column.summary.Count, &mean, &meanSq, &min, &max)
+		if err != nil {
+			return summary, err
+		}
+		if column.summary.Count == 0 {
+			continue
+		}
+		column.summary.Mean = mean.Float64
+		column.summary.StdDev = math.Sqrt(math.Max(0, meanSq.Float64-mean.Float64*mean.Float64))
+		column.summary.Min = min.Float64
+		column.summary.Max = max.Float64
+	}
+	return summary, nil
+}
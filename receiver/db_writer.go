@@ -0,0 +1,159 @@
+package receiver
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	dbWriteQueue = 4096 // Writes waiting for the writer before more are dropped
+	dbWriteBatch = 256  // Most writes committed in one transaction
+)
+
+// dbWriter applies the recorders' writes on its own goroutine, so that
+// waiting for SQLite to sync never holds up the readings. Writes queue up
+// while a transaction commits, and are then committed together, so the
+// busier the writer the fewer syncs each write costs. If the queue fills
+// anyway, writes are dropped rather than blocking, and counted.
+type dbWriter struct {
+	db    *sql.DB
+	queue chan dbWrite
+	done  chan struct{}
+
+	mu     sync.RWMutex // Held to send on queue, and exclusively to close it
+	closed bool
+
+	written atomic.Uint64
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+	batches atomic.Uint64
+}
+
+type dbWrite struct {
+	failure string // Logged if the write fails
+	apply   func(tx *sql.Tx) error
+}
+
+// DBWriterStats counts the database writer's work since it started.
+type DBWriterStats struct {
+	Queued  int    `json:"queued"` // Writes waiting now
+	Written uint64 `json:"written"`
+	Dropped uint64 `json:"dropped"` // Writes lost to a full queue
+	Failed  uint64 `json:"failed"`
+	Batches uint64 `json:"batches"` // Transactions committed
+}
+
+func newDBWriter(db *sql.DB) *dbWriter {
+	w := &dbWriter{
+		db:    db,
+		queue: make(chan dbWrite, dbWriteQueue),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// write queues apply to be run in a later transaction, logging failure
+// with the error if it fails. It returns false if
+// the writer has been closed, in which case the caller has to write for
+// itself.
+func (w *dbWriter) write(failure string, apply func(tx *sql.Tx) error) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return false
+	}
+	select {
+	case w.queue <- dbWrite{failure, apply}:
+	default:
+		if n := w.dropped.Add(1); n == 1 || n%1000 == 0 {
+			log.Printf("Database writer can't keep up, %d writes dropped", n)
+		}
+	}
+	return true
+}
+
+func (w *dbWriter) run() {
+	defer close(w.done)
+	for first := range w.queue {
+		batch := []dbWrite{first}
+	fill:
+		for len(batch) < dbWriteBatch {
+			select {
+			case write, ok := <-w.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, write)
+			default:
+				break fill
+			}
+		}
+
+		if err := w.commit(batch); err != nil {
+			// Try each on its own, so one bad write doesn't lose the rest
+			for _, write := range batch {
+				if err := w.commit([]dbWrite{write}); err != nil {
+					w.failed.Add(1)
+					log.Printf("%s: %v", write.failure, err)
+				}
+			}
+		}
+	}
+}
+
+func (w *dbWriter) commit(batch []dbWrite) error {
+	err := writeNow(w.db, func(tx *sql.Tx) error {
+		for _, write := range batch {
+			if err := write.apply(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.written.Add(uint64(len(batch)))
+	w.batches.Add(1)
+	return nil
+}
+
+// Stats returns the writer's counters.
+func (w *dbWriter) Stats() DBWriterStats {
+	return DBWriterStats{
+		Queued:  len(w.queue),
+		Written: w.written.Load(),
+		Dropped: w.dropped.Load(),
+		Failed:  w.failed.Load(),
+		Batches: w.batches.Load(),
+	}
+}
+
+// Close waits for the queued writes to be committed, and stops the writer.
+// Later writes are left to their callers.
+func (w *dbWriter) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+// writeNow runs apply in a transaction of its own.
+func writeNow(db *sql.DB, apply func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := apply(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,207 @@
+package receiver
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+)
+
+// Save the dial every this many oscillations. Anything lost in a crash
+// between saves is estimated back from the rate, like any other gap.
+const dialSaveInterval = 60
+
+// dial is a virtual clock dial. It counts completed oscillations, which
+// with the nominal period gives the time the clock's hands should show,
+// and compares that with host time since the user last set the hands.
+type dial struct {
+	oscillations float64 // Completed oscillations, including estimated ones
+	estimated    float64 // Oscillations estimated across gaps rather than counted
+	lastCrossing int64   // Host micros of the last positive-going zero crossing
+	period       float64 // Last measured period in seconds, for estimating gaps
+	unsaved      int
+
+	synced           bool
+	syncPending      bool    // Synced, but waiting for a crossing to fix the count
+	syncMicros       int64   // Host time at which the hands were set correctly
+	syncOscillations float64 // Oscillation count at that moment
+}
+
+// DialState reports the virtual dial for the /dial endpoint.
+type DialState struct {
+	Oscillations          float64  `json:"oscillations"`
+	EstimatedOscillations float64  `json:"estimated_oscillations"` // Included in Oscillations; counted across gaps from the rate
+	LastCrossing          int64    `json:"last_crossing"`
+	Synced                bool     `json:"synced"`
+	SyncTime              int64    `json:"sync_time,omitempty"`      // Unix micros when the hands were set
+	IndicatedTime         int64    `json:"indicated_time,omitempty"` // Unix micros the hands showed at LastCrossing
+	Error                 *float64 `json:"error"`                    // Seconds ahead of host time, null until synced with a nominal period
+}
+
+// oscillation records a positive-going zero crossing at hostMicros, first
+// estimating how many oscillations were missed if there was a gap.
+func (d *dial) oscillation(hostMicros int64, estimatedPeriod, nominal float64) {
+	if d.lastCrossing != 0 && hostMicros > d.lastCrossing {
+		interval := float64(hostMicros-d.lastCrossing) / 1e6
+		period := estimatedPeriod
+		if period <= 0 {
+			period = d.period
+		}
+		if period > 0 && interval > 1.5*period {
+			missed := math.Round(interval/period) - 1
+			d.oscillations += missed
+			d.estimated += missed
+			log.Printf("Estimated %.0f oscillations missed over a %.1fs gap", missed, interval)
+		} else {
+			d.period = interval
+		}
+	}
+
+	d.oscillations++
+	d.lastCrossing = hostMicros
+	d.unsaved++
+
+	if d.syncPending {
+		if nominal <= 0 {
+			nominal = d.period
+		}
+		d.syncPending = false
+		d.syncOscillations = d.oscillations
+		if nominal > 0 {
+			d.syncOscillations -= float64(hostMicros-d.syncMicros) / 1e6 / nominal
+		}
+		d.unsaved = dialSaveInterval // Save straight away
+	}
+}
+
+// sync records that the hands showed the correct time at hostMicros. The
+// oscillation count at that moment is worked out from the next crossing,
+// since the last one may be from before a gap.
+func (d *dial) sync(hostMicros int64) {
+	d.synced = true
+	d.syncPending = true
+	d.syncMicros = hostMicros
+}
+
+// errorSeconds returns how far ahead of host time the dial was at the last
+// crossing.
+func (d *dial) errorSeconds(nominal float64) (float64, bool) {
+	if !d.synced || d.syncPending || nominal <= 0 {
+		return 0, false
+	}
+	indicated := (d.oscillations - d.syncOscillations) * nominal
+	actual := float64(d.lastCrossing-d.syncMicros) / 1e6
+	return indicated - actual, true
+}
+
+func (d *dial) state(nominal float64) DialState {
+	state := DialState{
+		Oscillations:          d.oscillations,
+		EstimatedOscillations: d.estimated,
+		LastCrossing:          d.lastCrossing,
+		Synced:                d.synced,
+	}
+	if d.synced {
+		state.SyncTime = d.syncMicros
+	}
+	if e, ok := d.errorSeconds(nominal); ok {
+		state.Error = &e
+		state.IndicatedTime = d.lastCrossing + int64(math.Round(e*1e6))
+	}
+	return state
+}
+
+func loadDial(db *sql.DB, clockID string) (*dial, error) {
+	d := &dial{}
+	var syncMicros sql.NullInt64
+	var syncOscillations sql.NullFloat64
+	err := db.QueryRow(`
+		SELECT oscillations, estimated, last_crossing, period, sync_micros, sync_oscillations
+		FROM dial WHERE clock_id = ?
+	`, clockID).Scan(&d.oscillations, &d.estimated, &d.lastCrossing, &d.period, &syncMicros, &syncOscillations)
+	if errors.Is(err, sql.ErrNoRows) {
+		return d, nil
+	}
+	if err != nil {
+		return d, err
+	}
+	d.synced = syncMicros.Valid
+	d.syncPending = syncMicros.Valid && !syncOscillations.Valid
+	d.syncMicros = syncMicros.Int64
+	d.syncOscillations = syncOscillations.Float64
+	return d, nil
+}
+
+func (d *dial) save(db dbExecutor, clockID string) error {
+	var syncMicros sql.NullInt64
+	var syncOscillations sql.NullFloat64
+	if d.synced {
+		syncMicros = sql.NullInt64{Int64: d.syncMicros, Valid: true}
+		syncOscillations = sql.NullFloat64{Float64: d.syncOscillations, Valid: !d.syncPending}
+	}
+	_, err := db.Exec(`
+		INSERT INTO dial (clock_id, oscillations, estimated, last_crossing, period, sync_micros, sync_oscillations)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (clock_id) DO UPDATE SET
+			oscillations = excluded.oscillations,
+			estimated = excluded.estimated,
+			last_crossing = excluded.last_crossing,
+			period = excluded.period,
+			sync_micros = excluded.sync_micros,
+			sync_oscillations = excluded.sync_oscillations
+	`, clockID, d.oscillations, d.estimated, d.lastCrossing, d.period, syncMicros, syncOscillations)
+	return err
+}
+
+// saveDialIfDue persists the dial every dialSaveInterval oscillations.
+func (dr *DataRecorder) saveDialIfDue() {
+	if dr.dial.unsaved >= dialSaveInterval {
+		dr.saveDial()
+	}
+}
+
+// saveDial writes the dial as it is now.
+func (dr *DataRecorder) saveDial() error {
+	d, clockID := *dr.dial, dr.clockID
+	dr.dial.unsaved = 0
+	return dr.write("dial", func(tx *sql.Tx) error {
+		return d.save(tx, clockID)
+	})
+}
+
+// estimatedPeriod returns the clock's current period from its smoothed
+// rate, or 0 if there's no rate yet.
+func (dr *DataRecorder) estimatedPeriod() float64 {
+	nominal := dr.config.Period()
+	if nominal <= 0 || !dr.rate.valid {
+		return 0
+	}
+	return nominal / (1 + dr.rate.smoothed/secondsPerDay)
+}
+
+// Dial returns the state of the clock's virtual dial.
+func (dr *DataRecorder) Dial() DialState {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	return dr.dial.state(dr.config.Period())
+}
+
+// SyncDial records that the clock's hands showed the correct time at
+// hostMicros.
+func (dr *DataRecorder) SyncDial(hostMicros int64) error {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	dr.dial.sync(hostMicros)
+	return dr.saveDial()
+}
+
+// Close saves any state that isn't written as it changes. With a writer,
+// it should be closed first, so that this is written after everything
+// queued.
+func (dr *DataRecorder) Close() error {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	dr.writeCycles(0, true)
+	return errors.Join(dr.flushTrace(), dr.saveDial())
+}
@@ -0,0 +1,168 @@
+package receiver
+
+import "math"
+
+const (
+	energyWindow     = 2000 // Half-swings to fit over; a clock's amplitude wanders slowly
+	energyMinSwings  = 200
+	energyMinSpread  = 0.1 // Degrees; less variation than this is mostly measurement noise
+	energyMaxGapRate = 1.5 // A peak interval this much longer than the last means peaks were missed
+)
+
+// energyTracker estimates the oscillator's damping and the escapement's
+// drive from the amplitudes of successive half-swings.
+//
+// Each half-swing's amplitude is what was left of the previous one after
+// a half-swing of free decay, plus the escapement's impulse:
+//
+//	A[n+1] = d·A[n] + I
+//
+// where d = exp(-π/2Q) for an oscillator of quality factor Q. Fitting that
+// line over a window of swings separates the two, given the natural
+// variation of a running clock's amplitude. With too little variation
+// there's nothing to fit, and no estimate is made.
+type energyTracker struct {
+	amplitudes []float64 // Half-amplitudes about equilibrium, in degrees
+	lastTime   int64
+	lastGap    int64
+	lastSign   int
+}
+
+// energyEstimate is the result of fitting the decay line.
+type energyEstimate struct {
+	decay   float64 // Fraction of amplitude kept over a half-swing
+	impulse float64 // Degrees of amplitude added by each impulse
+}
+
+// q returns the quality factor corresponding to the decay.
+func (e energyEstimate) q() float64 {
+	return -math.Pi / (2 * math.Log(e.decay))
+}
+
+// impulseFraction returns the fraction of a swing of the given
+// half-amplitude's energy that was supplied by its impulse.
+func (e energyEstimate) impulseFraction(amplitude float64) float64 {
+	kept := amplitude - e.impulse
+	return 1 - kept*kept/(amplitude*amplitude)
+}
+
+// add records a peak of the given sign, position and time. Peaks must
+// alternate and come at a steady pace, or the history is discarded.
+func (et *energyTracker) add(sign int, position, equilibrium float64, micros int64) {
+	gap := micros - et.lastTime
+	if sign == et.lastSign || (et.lastGap > 0 && float64(gap) > energyMaxGapRate*float64(et.lastGap)) {
+		et.reset()
+	}
+	if et.lastTime != 0 {
+		et.lastGap = gap
+	}
+	et.lastTime = micros
+	et.lastSign = sign
+
+	et.amplitudes = append(et.amplitudes, math.Abs(position-equilibrium))
+	if len(et.amplitudes) > energyWindow {
+		et.amplitudes = et.amplitudes[len(et.amplitudes)-energyWindow:]
+	}
+}
+
+// estimate fits the decay line. ok is false until there are enough swings,
+// or if the fit is too uncertain to mean anything.
+//
+// Measurement noise in A[n] would bias an ordinary least-squares slope
+// towards zero, so A[n-1], whose noise is independent, is used as an
+// instrument for it.
+func (et *energyTracker) estimate() (energyEstimate, bool) {
+	a := et.amplitudes
+	n := len(a) - 2
+	if n < energyMinSwings {
+		return energyEstimate{}, false
+	}
+
+	var meanZ, meanX, meanY float64
+	for i := 0; i < n; i++ {
+		meanZ += a[i]
+		meanX += a[i+1]
+		meanY += a[i+2]
+	}
+	meanZ /= float64(n)
+	meanX /= float64(n)
+	meanY /= float64(n)
+
+	var szx, szy, szz float64
+	for i := 0; i < n; i++ {
+		dz := a[i] - meanZ
+		szx += dz * (a[i+1] - meanX)
+		szy += dz * (a[i+2] - meanY)
+		szz += dz * dz
+	}
+	if szx == 0 || math.Sqrt(szz/float64(n)) < energyMinSpread {
+		return energyEstimate{}, false
+	}
+	// Kendall's correction for the downward bias of a short AR(1) fit
+	decay := (float64(n)*szy/szx + 1) / float64(n-3)
+	impulse := meanY - decay*meanX
+	if decay <= 0 || decay >= 1 {
+		return energyEstimate{}, false
+	}
+
+	// Require the decay's standard error to be well inside its distance
+	// from 1, or Q could be anything
+	var ssr float64
+	for i := 0; i < n; i++ {
+		r := a[i+2] - (decay*a[i+1] + impulse)
+		ssr += r * r
+	}
+	stdErr := math.Sqrt(ssr/float64(n-2)*szz) / math.Abs(szx)
+	if stdErr > (1-decay)/2 {
+		return energyEstimate{}, false
+	}
+
+	return energyEstimate{decay: decay, impulse: impulse}, true
+}
+
+func (et *energyTracker) reset() {
+	et.amplitudes = et.amplitudes[:0]
+	et.lastTime = 0
+	et.lastGap = 0
+	et.lastSign = 0
+}
+
+// addPeakAmplitude feeds a newly detected peak to the energy tracker.
+func (dr *DataRecorder) addPeakAmplitude(sign int) {
+	if dr.positionUncertain {
+		dr.energy.reset()
+		return
+	}
+
+	peak := dr.lastPositivePeak
+	if sign < 0 {
+		peak = dr.lastNegativePeak
+	}
+	var equilibrium float64
+	if dr.haveMidpointRef {
+		equilibrium = dr.midpointRef
+	}
+	dr.energy.add(sign, peak.Position, equilibrium, peak.Time)
+}
+
+// addEnergy fills in the cycle's Q factor and impulse energy.
+func (dr *DataRecorder) addEnergy(cycle *HistoricalData) {
+	estimate, ok := dr.energy.estimate()
+	if !ok {
+		return
+	}
+
+	q := estimate.q()
+	amplitude := cycle.Amplitude / 2
+	fraction := estimate.impulseFraction(amplitude)
+	cycle.QFactor = &q
+	cycle.ImpulseFraction = &fraction
+
+	// A swing's energy is its peak kinetic energy, ½Jω²θ²
+	if inertia := dr.config.MomentOfInertia; inertia > 0 && cycle.Period > 0 {
+		omega := 2 * math.Pi / cycle.Period
+		theta := amplitude * math.Pi / 180
+		energy := fraction * inertia * omega * omega * theta * theta / 2 * 1e6
+		cycle.ImpulseEnergy = &energy
+	}
+}
@@ -0,0 +1,227 @@
+package receiver
+
+import (
+	"encoding/binary"
+)
+
+// Protocol v1 frames are 5 bytes: a 32-bit big-endian micros timestamp,
+// then a byte holding the direction in its top bit and a 7-bit XOR of the
+// timestamp bytes. Five 0xFF bytes mark a step lost to buffer overflow.
+//
+// Protocol v2 frames are 9 bytes: the header byte 0xA5, a 16-bit sequence
+// number that the sender increments for every encoder step whether or not
+// the step could be sent, the 32-bit timestamp, a flags byte with the
+// direction in its top bit, and a CRC-8 of the preceding 8 bytes.
+const (
+	frameSizeV1   = 5
+	frameSizeV2   = 9
+	frameHeaderV2 = 0xA5
+)
+
+// Frame is a single decoded packet from the encoder.
+type Frame struct {
+	Version   int
+	Timestamp uint32
+	Direction uint8
+	Sequence  uint16 // Protocol v2 only
+	Overflow  bool   // true for a 0xFF×5 buffer overflow marker
+}
+
+// FrameDecoder extracts frames from a byte stream of unknown alignment,
+// detecting which protocol version the sender speaks.
+//
+// While in sync it consumes one frame at a time. When a frame fails its
+// checksum it drops out of sync and slides along the window one byte at a
+// time until it finds a frame that validates and is followed by another
+// valid frame of the same version, trying the boundaries a single glitch
+// would leave first, so a dropped or corrupted byte costs at most the frame
+// it landed in. The exception is a v1 frame losing its first byte: the
+// misaligned frames still pass their checksums for as long as the
+// timestamps' high byte doesn't change, which v2's header byte prevents.
+type FrameDecoder struct {
+	window           []byte
+	version          int // 0 until a frame has been found
+	synced           bool
+	lost             bool // dropped out of sync and not yet searching byte by byte
+	skipped          int  // bytes discarded since the last frame was returned
+	checksumFailures uint64
+}
+
+func NewFrameDecoder() *FrameDecoder {
+	return &FrameDecoder{
+		window: make([]byte, 0, 256),
+	}
+}
+
+// Write appends received bytes to the decode window.
+func (d *FrameDecoder) Write(p []byte) {
+	d.window = append(d.window, p...)
+}
+
+// Next returns the next frame from the window. ok is false when more bytes
+// are needed. skipped is the number of bytes that were discarded to find
+// the returned frame, and is non-zero only after a resync.
+func (d *FrameDecoder) Next() (frame Frame, skipped int, ok bool) {
+	if d.synced {
+		size := frameSize(d.version)
+		if len(d.window) < size {
+			return Frame{}, 0, false
+		}
+		if f, valid := decodeFrame(d.version, d.window); valid {
+			d.consume(size)
+			return f, 0, true
+		}
+		d.checksumFailures++
+		d.synced = false
+		d.lost = true
+	}
+
+	// A single dropped, corrupted or extra byte leaves the next frame
+	// boundary within a byte of where it would have been. Those boundaries
+	// are tried first because v1 frames misaligned by a byte or two often
+	// pass their checksum, as neighbouring timestamps share their high
+	// bytes.
+	if d.lost {
+		size := frameSize(d.version)
+		for _, k := range []int{0, size - 1, size, size + 1} {
+			f, version, found, undecided := d.frameAt(k)
+			if undecided {
+				return Frame{}, 0, false
+			}
+			if found {
+				return d.resync(f, version, k)
+			}
+		}
+		d.lost = false
+	}
+
+	// Search for a frame boundary
+	k := 0
+	for ; k < len(d.window); k++ {
+		f, version, found, undecided := d.frameAt(k)
+		if found {
+			return d.resync(f, version, k)
+		}
+		if undecided {
+			break
+		}
+	}
+
+	// Discard everything that can no longer start a confirmed frame
+	d.skipped += k
+	d.consume(k)
+	return Frame{}, 0, false
+}
+
+// frameAt looks for a frame at offset k of the window, confirming it with
+// the following frame so that a chance checksum match on misaligned bytes
+// isn't accepted. undecided is true when there could be a frame at k once
+// more bytes arrive.
+func (d *FrameDecoder) frameAt(k int) (frame Frame, version int, found, undecided bool) {
+	if k >= len(d.window) {
+		return Frame{}, 0, false, true
+	}
+	for _, version := range []int{2, 1} {
+		size := frameSize(version)
+		if version == 2 && d.window[k] != frameHeaderV2 {
+			continue
+		}
+		if k+2*size > len(d.window) {
+			undecided = true
+			continue
+		}
+
+		f, valid := decodeFrame(version, d.window[k:])
+		if !valid {
+			continue
+		}
+		if _, next := decodeFrame(version, d.window[k+size:]); !next {
+			continue
+		}
+		return f, version, true, false
+	}
+	return Frame{}, 0, false, undecided
+}
+
+// resync returns the frame found at offset k, discarding the bytes before
+// it, and goes back into sync with its version.
+func (d *FrameDecoder) resync(frame Frame, version, k int) (Frame, int, bool) {
+	d.skipped += k
+	d.consume(k + frameSize(version))
+	d.synced = true
+	d.lost = false
+	d.version = version
+
+	skipped := d.skipped
+	d.skipped = 0
+	return frame, skipped, true
+}
+
+// Version returns the protocol version of the stream, or 0 if it isn't
+// known yet.
+func (d *FrameDecoder) Version() int {
+	return d.version
+}
+
+// ChecksumFailures returns how many in-sync frames have failed validation.
+func (d *FrameDecoder) ChecksumFailures() uint64 {
+	return d.checksumFailures
+}
+
+func (d *FrameDecoder) consume(n int) {
+	d.window = append(d.window[:0], d.window[n:]...)
+}
+
+func frameSize(version int) int {
+	if version == 2 {
+		return frameSizeV2
+	}
+	return frameSizeV1
+}
+
+// decodeFrame decodes the frame at the start of buf, which must hold at
+// least frameSize(version) bytes.
+func decodeFrame(version int, buf []byte) (Frame, bool) {
+	if version == 2 {
+		if buf[0] != frameHeaderV2 || calculateCRC8(buf[:8]) != buf[8] {
+			return Frame{}, false
+		}
+		return Frame{
+			Version:   2,
+			Sequence:  binary.BigEndian.Uint16(buf[1:3]),
+			Timestamp: binary.BigEndian.Uint32(buf[3:7]),
+			Direction: (buf[7] >> 7) & 1,
+		}, true
+	}
+
+	if isOverflowMarker(buf) {
+		return Frame{Version: 1, Overflow: true}, true
+	}
+	if !validChecksum(buf) {
+		return Frame{}, false
+	}
+	return Frame{
+		Version:   1,
+		Timestamp: binary.BigEndian.Uint32(buf[:4]),
+		Direction: (buf[4] >> 7) & 1,
+	}, true
+}
+
+func isOverflowMarker(buf []byte) bool {
+	for i := 0; i < frameSizeV1; i++ {
+		if buf[i] != 0xFF {
+			return false
+		}
+	}
+	return true
+}
+
+func validChecksum(buf []byte) bool {
+	calculatedChecksum := uint8(0)
+	for i := 0; i < 4; i++ {
+		calculatedChecksum ^= buf[i]
+	}
+	calculatedChecksum &= 0x7F
+
+	return calculatedChecksum == buf[4]&0x7F
+}
@@ -0,0 +1,206 @@
+package receiver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func encodeFrameV1(timestamp uint32, direction uint8) []byte {
+	frame := make([]byte, frameSizeV1)
+	binary.BigEndian.PutUint32(frame[:4], timestamp)
+	checksum := (frame[0] ^ frame[1] ^ frame[2] ^ frame[3]) & 0x7F
+	frame[4] = direction<<7 | checksum
+	return frame
+}
+
+func encodeFrameV2(sequence uint16, timestamp uint32, direction uint8) []byte {
+	frame := make([]byte, frameSizeV2)
+	frame[0] = frameHeaderV2
+	binary.BigEndian.PutUint16(frame[1:3], sequence)
+	binary.BigEndian.PutUint32(frame[3:7], timestamp)
+	frame[7] = direction << 7
+	frame[8] = calculateCRC8(frame[:8])
+	return frame
+}
+
+// testStream returns n frames of the given version, with their timestamps.
+func testStream(version, n int, start uint32) ([]byte, []uint32) {
+	var stream []byte
+	var timestamps []uint32
+	for i := 0; i < n; i++ {
+		timestamp := start + uint32(i)*12345
+		direction := uint8(i % 2)
+		if version == 2 {
+			stream = append(stream, encodeFrameV2(uint16(i), timestamp, direction)...)
+		} else {
+			stream = append(stream, encodeFrameV1(timestamp, direction)...)
+		}
+		timestamps = append(timestamps, timestamp)
+	}
+	return stream, timestamps
+}
+
+// without returns timestamps with the i'th left out.
+func without(timestamps []uint32, i int) []uint32 {
+	return slices.Delete(slices.Clone(timestamps), i, i+1)
+}
+
+func TestFrameDecoder(t *testing.T) {
+	v1, v1Times := testStream(1, 10, 1000000)
+	v2, v2Times := testStream(2, 10, 2000000)
+
+	tests := []struct {
+		name           string
+		stream         []byte
+		wantTimestamps []uint32
+		wantVersions   []int // Of the frames in order, if they differ
+		wantSkipped    bool
+		wantFailures   uint64
+	}{
+		{
+			name:           "v1",
+			stream:         v1,
+			wantTimestamps: v1Times,
+		},
+		{
+			name:           "v2",
+			stream:         v2,
+			wantTimestamps: v2Times,
+		},
+		{
+			name:           "v1 with leading garbage",
+			stream:         append([]byte{0x12, 0x34, 0x56}, v1...),
+			wantTimestamps: v1Times,
+			wantSkipped:    true,
+		},
+		{
+			name:           "v1 dropped byte",
+			stream:         slices.Delete(slices.Clone(v1), 4*frameSizeV1+2, 4*frameSizeV1+3),
+			wantTimestamps: without(v1Times, 4),
+			wantSkipped:    true,
+			wantFailures:   1,
+		},
+		{
+			name:           "v2 dropped byte",
+			stream:         slices.Delete(slices.Clone(v2), 4*frameSizeV2+5, 4*frameSizeV2+6),
+			wantTimestamps: without(v2Times, 4),
+			wantSkipped:    true,
+			wantFailures:   1,
+		},
+		{
+			name: "v1 corrupted byte",
+			stream: func() []byte {
+				s := slices.Clone(v1)
+				s[4*frameSizeV1+1] ^= 0x10
+				return s
+			}(),
+			wantTimestamps: without(v1Times, 4),
+			wantSkipped:    true,
+			wantFailures:   1,
+		},
+		{
+			name: "v2 corrupted byte",
+			stream: func() []byte {
+				s := slices.Clone(v2)
+				s[4*frameSizeV2+4] ^= 0x10
+				return s
+			}(),
+			wantTimestamps: without(v2Times, 4),
+			wantSkipped:    true,
+			wantFailures:   1,
+		},
+		{
+			name:           "v1 to v2",
+			stream:         append(slices.Clone(v1), v2...),
+			wantTimestamps: append(slices.Clone(v1Times), v2Times...),
+			wantVersions:   []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
+			wantFailures:   1,
+		},
+		{
+			name:           "v2 to v1",
+			stream:         append(slices.Clone(v2), v1...),
+			wantTimestamps: append(slices.Clone(v2Times), v1Times...),
+			wantVersions:   []int{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+			wantFailures:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		// The result mustn't depend on how the stream is split into reads
+		for _, chunk := range []int{len(tt.stream), 7, 1} {
+			t.Run(fmt.Sprintf("%s in chunks of %d", tt.name, chunk), func(t *testing.T) {
+				d := NewFrameDecoder()
+				var timestamps []uint32
+				var versions []int
+				skipped := 0
+				for start := 0; start < len(tt.stream); start += chunk {
+					d.Write(tt.stream[start:min(start+chunk, len(tt.stream))])
+					for {
+						frame, n, ok := d.Next()
+						if !ok {
+							break
+						}
+						timestamps = append(timestamps, frame.Timestamp)
+						versions = append(versions, frame.Version)
+						skipped += n
+					}
+				}
+
+				if !slices.Equal(timestamps, tt.wantTimestamps) {
+					t.Errorf("got timestamps %v, want %v", timestamps, tt.wantTimestamps)
+				}
+				if tt.wantVersions != nil && !slices.Equal(versions, tt.wantVersions) {
+					t.Errorf("got versions %v, want %v", versions, tt.wantVersions)
+				}
+				if tt.wantSkipped && skipped == 0 {
+					t.Error("no bytes reported skipped")
+				}
+				if d.ChecksumFailures() != tt.wantFailures {
+					t.Errorf("%d checksum failures, want %d", d.ChecksumFailures(), tt.wantFailures)
+				}
+			})
+		}
+	}
+}
+
+// TestFrameDecoderGlitches drops, corrupts or inserts a byte at every
+// position of a frame, which must cost no more than that frame.
+func TestFrameDecoderGlitches(t *testing.T) {
+	glitches := []struct {
+		name  string
+		apply func(stream []byte, i int) []byte
+	}{
+		{"dropped", func(s []byte, i int) []byte { return slices.Delete(s, i, i+1) }},
+		{"corrupted", func(s []byte, i int) []byte { s[i] ^= 0x10; return s }},
+		{"inserted", func(s []byte, i int) []byte { return slices.Insert(s, i, 0x5A) }},
+	}
+
+	for _, version := range []int{1, 2} {
+		size := frameSize(version)
+		stream, timestamps := testStream(version, 12, 1000000)
+		for _, glitch := range glitches {
+			for pos := 0; pos < size; pos++ {
+				// Undetectable in v1, see FrameDecoder
+				if version == 1 && glitch.name == "dropped" && pos == 0 {
+					continue
+				}
+
+				d := NewFrameDecoder()
+				d.Write(glitch.apply(slices.Clone(stream), 4*size+pos))
+				var got []uint32
+				for {
+					frame, _, ok := d.Next()
+					if !ok {
+						break
+					}
+					got = append(got, frame.Timestamp)
+				}
+				if !slices.Equal(got, timestamps) && !slices.Equal(got, without(timestamps, 4)) {
+					t.Errorf("v%d byte %d %s: got timestamps %v", version, pos, glitch.name, got)
+				}
+			}
+		}
+	}
+}
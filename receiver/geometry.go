@@ -0,0 +1,80 @@
+package receiver
+
+import (
+	"errors"
+	"math"
+)
+
+// EncoderGeometry describes how encoder counts relate to the balance
+// wheel's angle.
+type EncoderGeometry struct {
+	Resolution          int     `json:"resolution"`            // Encoder lines per revolution
+	CountsPerRevolution int     `json:"counts_per_revolution"` // Counts per encoder revolution; 0 means 4 × Resolution, as the sender decodes every edge of both channels
+	GearRatio           float64 `json:"gear_ratio"`            // Encoder revolutions per balance wheel revolution
+	Inverted            bool    `json:"inverted"`              // Counts go down as the balance turns in the positive direction
+}
+
+// DefaultEncoderGeometry is the original 45-line encoder on the balance
+// staff, giving 2 degrees per count.
+func DefaultEncoderGeometry() EncoderGeometry {
+	return EncoderGeometry{
+		Resolution: 45,
+		GearRatio:  1,
+	}
+}
+
+func (g EncoderGeometry) Validate() error {
+	if g.Resolution <= 0 && g.CountsPerRevolution <= 0 {
+		return errors.New("resolution or counts_per_revolution must be positive")
+	}
+	if g.CountsPerRevolution < 0 {
+		return errors.New("counts_per_revolution must not be negative")
+	}
+	if g.GearRatio <= 0 {
+		return errors.New("gear_ratio must be positive")
+	}
+	return nil
+}
+
+func (g EncoderGeometry) countsPerRevolution() int {
+	if g.CountsPerRevolution > 0 {
+		return g.CountsPerRevolution
+	}
+	return 4 * g.Resolution
+}
+
+// DegreesPerCount returns the balance wheel rotation in degrees for each
+// encoder count. It is the size of the quantization step.
+func (g EncoderGeometry) DegreesPerCount() float64 {
+	return 360 / (float64(g.countsPerRevolution()) * g.GearRatio)
+}
+
+// Degrees converts an encoder count to the balance wheel's angle.
+func (g EncoderGeometry) Degrees(count float64) float64 {
+	degrees := count * g.DegreesPerCount()
+	if g.Inverted {
+		return -degrees
+	}
+	return degrees
+}
+
+// Counts converts a balance wheel angle to the nearest whole count.
+func (g EncoderGeometry) Counts(degrees float64) int {
+	counts := degrees / g.DegreesPerCount()
+	if g.Inverted {
+		counts = -counts
+	}
+	return int(math.Round(counts))
+}
+
+// EdgeDegrees returns the angle at which the count changed to count. The
+// sender reports a count when the encoder crosses into it, which is at the
+// count's lower edge when counting up, and the next count's lower edge when
+// counting down.
+func (g EncoderGeometry) EdgeDegrees(count int, up bool) float64 {
+	edge := float64(count)
+	if !up {
+		edge++
+	}
+	return g.Degrees(edge)
+}
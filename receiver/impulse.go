@@ -0,0 +1,179 @@
+package receiver
+
+import "math"
+
+const (
+	impulseWindow     = 0.2 // Fraction of a half-swing either side of the crossing to search
+	impulseMinSamples = 12
+	impulseBreaks     = 40  // Candidate start and end times to try
+	impulseMinSigma   = 3.0 // Required significance of the impulse, in standard errors
+)
+
+// ImpulseFit describes one escapement impulse, found as a change in the
+// wheel's velocity through the zero crossing that free oscillation doesn't
+// account for.
+type ImpulseFit struct {
+	Unlock    float64 // Start of the impulse, in milliseconds from the zero crossing
+	Drop      float64 // End of the impulse, when the escape wheel drops on to lock
+	Magnitude float64 // Degrees of amplitude added
+}
+
+// fitImpulse looks for the impulse in samples either side of a zero
+// crossing at crossing micros, given the free swing's angular frequency
+// omega and equilibrium.
+//
+// The velocity is estimated at each encoder edge, and the free oscillator's
+// acceleration of -ω²(θ - c) is integrated out of it, which leaves the
+// escapement's contribution as a ramp between two otherwise straight
+// sections. The straight sections slope with the damping. The start and end
+// of the ramp are found by trying every pair from a grid of times and
+// solving the rest by linear least squares.
+func fitImpulse(samples []swingSample, crossing, omega, equilibrium float64) *ImpulseFit {
+	n := len(samples) - 2
+	if n < impulseMinSamples || omega <= 0 {
+		return nil
+	}
+
+	ts := make([]float64, n)
+	us := make([]float64, n)
+	var integral float64
+	for i := 1; i <= n; i++ {
+		prev, s, next := samples[i-1], samples[i], samples[i+1]
+		if next.t <= prev.t {
+			return nil
+		}
+		if i > 1 {
+			dt := (s.t - prev.t) / 1e6
+			integral += dt * ((prev.degrees+s.degrees)/2 - equilibrium)
+		}
+		v := (next.degrees - prev.degrees) / ((next.t - prev.t) / 1e6)
+		ts[i-1] = (s.t - crossing) / 1e6
+		us[i-1] = v + omega*omega*integral
+	}
+	direction := 1.0
+	if samples[n+1].degrees < samples[0].degrees {
+		direction = -1
+	}
+
+	// Candidate breaks evenly through the window
+	breaks := make([]float64, impulseBreaks)
+	for i := range breaks {
+		breaks[i] = ts[0] + (ts[n-1]-ts[0])*float64(i)/float64(impulseBreaks-1)
+	}
+
+	bestSSR := math.Inf(1)
+	var best ImpulseFit
+	var bestStep, bestStepErr float64
+	for i, start := range breaks {
+		for _, end := range breaks[i:] {
+			coeffs, ssr, stepVar, ok := fitRamp(ts, us, start, end)
+			if !ok || ssr >= bestSSR {
+				continue
+			}
+			bestSSR = ssr
+			bestStep = coeffs[2]
+			bestStepErr = math.Sqrt(ssr / float64(n-3) * stepVar)
+			best = ImpulseFit{
+				Unlock: start * 1000,
+				Drop:   end * 1000,
+			}
+		}
+	}
+	if math.IsInf(bestSSR, 1) || direction*bestStep <= impulseMinSigma*bestStepErr {
+		return nil
+	}
+
+	// Near equilibrium the swing's amplitude is its speed over ω
+	best.Magnitude = direction * bestStep / omega
+	return &best
+}
+
+// fitRamp fits u = a + b·t + step·ramp(t), where the ramp rises from 0 at
+// start to 1 at end, returning the coefficients, the sum of squared
+// residuals, and the unscaled variance of the step.
+func fitRamp(ts, us []float64, start, end float64) ([]float64, float64, float64, bool) {
+	ramp := func(t float64) float64 {
+		switch {
+		case t >= end:
+			return 1
+		case t <= start:
+			return 0
+		default:
+			return (t - start) / (end - start)
+		}
+	}
+
+	ata := [][]float64{make([]float64, 3), make([]float64, 3), make([]float64, 3)}
+	aty := make([]float64, 3)
+	for i, t := range ts {
+		row := [3]float64{1, t, ramp(t)}
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				ata[j][k] += row[j] * row[k]
+			}
+			aty[j] += row[j] * us[i]
+		}
+	}
+
+	coeffs, ok := solveLinear(ata, aty)
+	if !ok {
+		return nil, 0, 0, false
+	}
+	// The step's variance is the last diagonal element of the inverse
+	inverse, ok := solveLinear(ata, []float64{0, 0, 1})
+	if !ok {
+		return nil, 0, 0, false
+	}
+
+	var ssr float64
+	for i, t := range ts {
+		r := us[i] - (coeffs[0] + coeffs[1]*t + coeffs[2]*ramp(t))
+		ssr += r * r
+	}
+	return coeffs, ssr, inverse[2], true
+}
+
+// findImpulse is called at the end of each half-swing with the swing's
+// samples. It looks for the impulse at the crossing that started the swing,
+// using the end of the swing before, and keeps the end of this swing for
+// the next impulse.
+func (dr *DataRecorder) findImpulse(samples []swingSample, fit *SwingFit) {
+	dr.lastImpulse = nil
+	if fit != nil && len(dr.impulseTail) > 0 && !dr.positionUncertain {
+		window := impulseWindow * fit.Duration() * 1e6
+		around := append([]swingSample(nil), dr.impulseTail...)
+		for _, s := range samples {
+			if s.t > dr.impulseCrossing+window {
+				break
+			}
+			if s.t > around[len(around)-1].t {
+				around = append(around, s)
+			}
+		}
+		dr.lastImpulse = fitImpulse(around, dr.impulseCrossing, fit.Omega, fit.Equilibrium)
+	}
+
+	// Keep the end of this swing, before the crossing that ends it
+	dr.impulseTail = dr.impulseTail[:0]
+	dr.impulseCrossing = float64(dr.lastZeroCrossing.Time)
+	if fit == nil {
+		return
+	}
+	window := impulseWindow * fit.Duration() * 1e6
+	for _, s := range samples {
+		if s.t >= dr.impulseCrossing-window {
+			dr.impulseTail = append(dr.impulseTail, s)
+		}
+	}
+}
+
+// addImpulse fills in the cycle's impulse timing.
+func (dr *DataRecorder) addImpulse(cycle *HistoricalData) {
+	if dr.lastImpulse == nil {
+		return
+	}
+	impulse := *dr.lastImpulse
+	cycle.UnlockTime = &impulse.Unlock
+	cycle.DropTime = &impulse.Drop
+	cycle.ImpulseMagnitude = &impulse.Magnitude
+}
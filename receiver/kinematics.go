@@ -0,0 +1,125 @@
+package receiver
+
+import "math"
+
+// Kinematics is the balance wheel's smoothed angle, angular velocity and
+// angular acceleration at the time of one encoder edge.
+type Kinematics struct {
+	TotalMicros  uint64  `json:"total_micros"`
+	Position     float64 `json:"position"`     // Degrees
+	Velocity     float64 `json:"velocity"`     // Degrees per second
+	Acceleration float64 `json:"acceleration"` // Degrees per second squared
+}
+
+// kinematicsFilter is a Savitzky–Golay filter over the encoder edges. A
+// polynomial is fitted by least squares to a window of edges centred on
+// the one being estimated, and the velocity and acceleration are its
+// derivatives there. The edges aren't evenly spaced in time, so the fit is
+// solved afresh for each window rather than with fixed coefficients.
+//
+// Each estimate is for the edge in the middle of the window, so it lags
+// the latest reading by half the window.
+type kinematicsFilter struct {
+	samples []swingSample
+}
+
+func (kf *kinematicsFilter) reset() {
+	kf.samples = kf.samples[:0]
+}
+
+// add records the next edge, and returns the estimate for the middle of
+// the window once the window is full.
+func (kf *kinematicsFilter) add(sample swingSample, window, order int) *Kinematics {
+	kf.samples = append(kf.samples, sample)
+	if len(kf.samples) > window {
+		kf.samples = append(kf.samples[:0], kf.samples[len(kf.samples)-window:]...)
+	}
+	if len(kf.samples) < window {
+		return nil
+	}
+
+	// Fit in units of the window's span about the middle edge, for
+	// conditioning
+	centre := kf.samples[window/2]
+	span := (kf.samples[window-1].t - kf.samples[0].t) / 1e6
+	if span <= 0 {
+		return nil
+	}
+	size := order + 1
+	ata := make([][]float64, size)
+	for i := range ata {
+		ata[i] = make([]float64, size)
+	}
+	aty := make([]float64, size)
+	row := make([]float64, size)
+	for _, s := range kf.samples {
+		x := (s.t - centre.t) / 1e6 / span
+		power := 1.0
+		for j := range row {
+			row[j] = power
+			power *= x
+		}
+		for j := range row {
+			for k := range row {
+				ata[j][k] += row[j] * row[k]
+			}
+			aty[j] += row[j] * s.degrees
+		}
+	}
+
+	coeffs, ok := solveLinear(ata, aty)
+	if !ok {
+		return nil
+	}
+	return &Kinematics{
+		TotalMicros:  uint64(centre.t),
+		Position:     coeffs[0],
+		Velocity:     coeffs[1] / span,
+		Acceleration: 2 * coeffs[2] / (span * span),
+	}
+}
+
+// addKinematics filters the latest edge, and keeps track of the wheel's
+// top speed through each passage of zero, from one turning point to the
+// next.
+func (dr *DataRecorder) addKinematics(sample swingSample) *Kinematics {
+	k := dr.kinematics.add(sample, dr.config.KinematicsWindow, dr.config.KinematicsOrder)
+	if k != nil {
+		dr.passageSpeed = math.Max(dr.passageSpeed, math.Abs(k.Velocity))
+	}
+	return k
+}
+
+// resetKinematics discards the filter's window, after a jump in the
+// position that would show up as a spike in velocity.
+func (dr *DataRecorder) resetKinematics() {
+	dr.kinematics.reset()
+	dr.passageSpeed = 0
+	dr.passageSpeeds = dr.passageSpeeds[:0]
+}
+
+// endPassage is called at each turning point.
+func (dr *DataRecorder) endPassage() {
+	if dr.passageSpeed > 0 {
+		dr.passageSpeeds = append(dr.passageSpeeds, dr.passageSpeed)
+		if len(dr.passageSpeeds) > 2 {
+			dr.passageSpeeds = dr.passageSpeeds[1:]
+		}
+	}
+	dr.passageSpeed = 0
+}
+
+// addPeakVelocity fills in the cycle's peak velocity from the last two
+// passages, and the amplitude it implies. A free oscillator of amplitude R
+// and angular frequency ω peaks at a speed of ωR.
+func (dr *DataRecorder) addPeakVelocity(cycle *HistoricalData) {
+	if len(dr.passageSpeeds) < 2 || cycle.Period <= 0 {
+		return
+	}
+	speed := (dr.passageSpeeds[0] + dr.passageSpeeds[1]) / 2
+	omega := 2 * math.Pi / cycle.Period
+	// Amplitude is measured from one side to the other, so twice R
+	amplitude := 2 * speed / omega
+	cycle.PeakVelocity = &speed
+	cycle.VelocityAmplitude = &amplitude
+}
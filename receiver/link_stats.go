@@ -0,0 +1,84 @@
+package receiver
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LinkStats counts events on the encoder link. It outlives individual
+// readers so the totals cover reconnects.
+type LinkStats struct {
+	frames             atomic.Uint64
+	bytes              atomic.Uint64
+	checksumFailures   atomic.Uint64
+	overflowMarkers    atomic.Uint64
+	timestampWraps     atomic.Uint64
+	resyncs            atomic.Uint64
+	errorDisconnects   atomic.Uint64
+	backpressureStalls atomic.Uint64
+
+	mu         sync.Mutex
+	started    time.Time
+	lastTick   time.Time
+	lastFrames uint64
+	fps        float64
+}
+
+// LinkStatsMessage is a snapshot of LinkStats, as served at /stats and
+// pushed over the WebSocket.
+type LinkStatsMessage struct {
+	Type               string  `json:"type"`
+	ClockID            string  `json:"clock_id"`
+	Uptime             float64 `json:"uptime"` // Seconds
+	FramesPerSecond    float64 `json:"frames_per_second"`
+	Frames             uint64  `json:"frames"`
+	BytesReceived      uint64  `json:"bytes_received"`
+	ChecksumFailures   uint64  `json:"checksum_failures"`
+	OverflowMarkers    uint64  `json:"overflow_markers"`
+	TimestampWraps     uint64  `json:"timestamp_wraps"`
+	Resyncs            uint64  `json:"resyncs"`
+	ErrorDisconnects   uint64  `json:"error_disconnects"`   // Disconnects after too many consecutive read errors
+	BackpressureStalls uint64  `json:"backpressure_stalls"` // Readings that had to wait for the consumer
+}
+
+func NewLinkStats() *LinkStats {
+	now := time.Now()
+	return &LinkStats{started: now, lastTick: now}
+}
+
+// Tick updates the frame rate from the frames counted since the previous
+// tick.
+func (ls *LinkStats) Tick() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	now := time.Now()
+	frames := ls.frames.Load()
+	if elapsed := now.Sub(ls.lastTick).Seconds(); elapsed > 0 {
+		ls.fps = float64(frames-ls.lastFrames) / elapsed
+	}
+	ls.lastTick = now
+	ls.lastFrames = frames
+}
+
+func (ls *LinkStats) Snapshot() LinkStatsMessage {
+	ls.mu.Lock()
+	fps := ls.fps
+	uptime := time.Since(ls.started).Seconds()
+	ls.mu.Unlock()
+
+	return LinkStatsMessage{
+		Type:               "LINK_STATS",
+		Uptime:             uptime,
+		FramesPerSecond:    fps,
+		Frames:             ls.frames.Load(),
+		BytesReceived:      ls.bytes.Load(),
+		ChecksumFailures:   ls.checksumFailures.Load(),
+		OverflowMarkers:    ls.overflowMarkers.Load(),
+		TimestampWraps:     ls.timestampWraps.Load(),
+		Resyncs:            ls.resyncs.Load(),
+		ErrorDisconnects:   ls.errorDisconnects.Load(),
+		BackpressureStalls: ls.backpressureStalls.Load(),
+	}
+}
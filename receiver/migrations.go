@@ -0,0 +1,461 @@
+package receiver
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// dbExecutor is satisfied by both *sql.DB and *sql.Tx.
+type dbExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// migration is one change to the database schema. Each runs in its own
+// transaction, together with recording the new version.
+type migration struct {
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// migrations upgrade the schema in order, and the schema's version is the
+// number that have been applied. Once released a migration mustn't change;
+// further changes go in new ones at the end.
+//
+// Databases from before the schema was versioned start at version 0 in
+// any state up to version 5's, so the first five check what's already
+// there. Later ones can rely on the previous version's schema.
+var migrations = []migration{
+	{"Create the readings table", migrateReadings},
+	{"Create the clock_config table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS clock_config (
+				clock_id TEXT PRIMARY KEY,
+				config TEXT NOT NULL
+			)
+		`)
+		return err
+	}},
+	{"Create the dial table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS dial (
+				clock_id TEXT PRIMARY KEY,
+				oscillations REAL NOT NULL,
+				estimated REAL NOT NULL,
+				last_crossing INTEGER NOT NULL,
+				period REAL NOT NULL,
+				sync_micros INTEGER,
+				sync_oscillations REAL
+			)
+		`)
+		return err
+	}},
+	{"Create the trace table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS trace (
+				clock_id TEXT NOT NULL,
+				start_micros INTEGER NOT NULL,
+				end_micros INTEGER NOT NULL,
+				host_end INTEGER NOT NULL,
+				events INTEGER NOT NULL,
+				data BLOB NOT NULL
+			)
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("CREATE INDEX IF NOT EXISTS trace_time ON trace (clock_id, start_micros)")
+		return err
+	}},
+	{"Create the rollup tables", createRollupTablesV1},
+	{"Record sensor reading ages, and clear sensor values from before the sensors reported", migrateSensorAges},
+}
+
+// Migration describes one migration, for reporting.
+type Migration struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+}
+
+// readingsColumnsV1 is the readings table as the first migration creates
+// it, which later migrations add to.
+const readingsColumnsV1 = `
+	clock_id TEXT NOT NULL DEFAULT 'default',
+	total_micros INTEGER NOT NULL,
+	timestamp_drift INTEGER,
+	amplitude REAL,
+	period REAL,
+	beat_error REAL,
+	rate REAL,
+	rate_smoothed REAL,
+	accumulated_error REAL,
+	fit_period REAL,
+	fit_amplitude REAL,
+	fit_beat_error REAL,
+	fit_residual REAL,
+	q_factor REAL,
+	impulse_fraction REAL,
+	impulse_energy REAL,
+	unlock_time REAL,
+	drop_time REAL,
+	impulse_magnitude REAL,
+	peak_velocity REAL,
+	velocity_amplitude REAL,
+	bmp180_temperature REAL,
+	bmp180_pressure REAL,
+	bmp390_temperature REAL,
+	bmp390_pressure REAL,
+	sht85_temperature REAL,
+	sht85_humidity REAL,
+	clock_offset INTEGER,
+	clock_skew_ppm REAL,
+	position_uncertain INTEGER,
+	lost_steps INTEGER,
+	PRIMARY KEY (clock_id, total_micros)
+`
+
+// migrateReadings creates the readings table, or brings one from an
+// unversioned build up to date.
+func migrateReadings(tx *sql.Tx) error {
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS readings (" + readingsColumnsV1 + ")"); err != nil {
+		return err
+	}
+
+	// Columns added since the table was first created
+	for _, column := range []struct{ name, definition string }{
+		{"clock_offset", "INTEGER"},
+		{"clock_skew_ppm", "REAL"},
+		{"position_uncertain", "INTEGER"},
+		{"lost_steps", "INTEGER"},
+		{"beat_error", "REAL"},
+		{"rate", "REAL"},
+		{"rate_smoothed", "REAL"},
+		{"accumulated_error", "REAL"},
+		{"fit_period", "REAL"},
+		{"fit_amplitude", "REAL"},
+		{"fit_beat_error", "REAL"},
+		{"fit_residual", "REAL"},
+		{"q_factor", "REAL"},
+		{"impulse_fraction", "REAL"},
+		{"impulse_energy", "REAL"},
+		{"unlock_time", "REAL"},
+		{"drop_time", "REAL"},
+		{"impulse_magnitude", "REAL"},
+		{"peak_velocity", "REAL"},
+		{"velocity_amplitude", "REAL"},
+	} {
+		if err := addColumnIfMissing(tx, "readings", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	return addClockIDToReadings(tx)
+}
+
+// columnNames returns the names of table's columns.
+func columnNames(db dbExecutor, table string) ([]string, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// addColumnIfMissing lets a database created by an older build pick up
+// new columns.
+func addColumnIfMissing(db dbExecutor, table, column, definition string) error {
+	names, err := columnNames(db, table)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == column {
+			return nil
+		}
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// addClockIDToReadings upgrades a readings table from before multiple
+// clocks were supported. The primary key has to change to include the
+// clock, which SQLite can only do by rebuilding the table. Existing rows
+// are assigned to DefaultClockID.
+func addClockIDToReadings(tx *sql.Tx) error {
+	names, err := columnNames(tx, "readings")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == "clock_id" {
+			return nil
+		}
+	}
+
+	log.Println("Upgrading readings table for multiple clocks")
+	columns := strings.Join(names, ", ")
+	for _, stmt := range []string{
+		"ALTER TABLE readings RENAME TO readings_old",
+		"CREATE TABLE readings (" + readingsColumnsV1 + ")",
+		fmt.Sprintf("INSERT INTO readings (%s) SELECT %s FROM readings_old", columns, columns),
+		"DROP TABLE readings_old",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollupTablesV1 and rollupColumnsV1 are the rollup tables as the fifth
+// migration creates them.
+var rollupTablesV1 = []struct {
+	name   string
+	micros int64
+}{
+	{"rollup_1m", 60 * 1000000},
+	{"rollup_1h", 3600 * 1000000},
+	{"rollup_1d", 86400 * 1000000},
+}
+
+var rollupColumnsV1 = []string{
+	"period",
+	"amplitude",
+	"rate",
+	"bmp180_temperature",
+	"bmp180_pressure",
+	"bmp390_temperature",
+	"bmp390_pressure",
+	"sht85_temperature",
+	"sht85_humidity",
+}
+
+// createRollupTablesV1 creates any missing rollup tables, and fills them in
+// from the readings already recorded.
+func createRollupTablesV1(tx *sql.Tx) error {
+	names, err := columnNames(tx, rollupTablesV1[0].name)
+	if err != nil {
+		return err
+	}
+	created := len(names) == 0
+
+	var columns []string
+	for _, column := range rollupColumnsV1 {
+		columns = append(columns,
+			column+"_count INTEGER NOT NULL",
+			column+"_sum REAL NOT NULL",
+			column+"_sum_sq REAL NOT NULL",
+			column+"_min REAL",
+			column+"_max REAL",
+		)
+	}
+	for _, table := range rollupTablesV1 {
+		_, err := tx.Exec(fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+				clock_id TEXT NOT NULL,
+				bucket_start INTEGER NOT NULL,
+				count INTEGER NOT NULL,
+				%s,
+				PRIMARY KEY(clock_id, bucket_start)
+			)
+		`, table.name, strings.Join(columns, ",\n")))
+		if err != nil {
+			return err
+		}
+	}
+	if !created {
+		return nil
+	}
+	log.Println("Building rollups")
+	return rebuildRollupsV1(tx, false)
+}
+
+// rebuildRollupsV1 recomputes the fifth migration's rollup tables from the
+// readings table, for every clock. With wholeBuckets set, buckets that
+// start before a clock's oldest reading are left alone, as readings may
+// have been pruned from them.
+func rebuildRollupsV1(tx *sql.Tx, wholeBuckets bool) error {
+	var aggregates []string
+	for _, column := range rollupColumnsV1 {
+		aggregates = append(aggregates, fmt.Sprintf(
+			"COUNT(%[1]s), TOTAL(%[1]s), TOTAL(%[1]s * %[1]s), MIN(%[1]s), MAX(%[1]s)", column))
+	}
+	// The first bucket of each clock to rebuild
+	first := "oldest - oldest % ?1"
+	if wholeBuckets {
+		first = "(oldest + ?1 - 1) / ?1 * ?1"
+	}
+
+	for _, table := range rollupTablesV1 {
+		_, err := tx.Exec(fmt.Sprintf(`
+			WITH kept AS (
+				SELECT clock_id, %[2]s AS first
+				FROM (SELECT clock_id, MIN(total_micros) AS oldest FROM readings GROUP BY clock_id)
+			)
+			DELETE FROM %[1]s
+			WHERE bucket_start >= (SELECT first FROM kept WHERE kept.clock_id = %[1]s.clock_id)
+		`, table.name, first), table.micros)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf(`
+			WITH kept AS (
+				SELECT clock_id, %[2]s AS first
+				FROM (SELECT clock_id, MIN(total_micros) AS oldest FROM readings GROUP BY clock_id)
+			)
+			INSERT INTO %[1]s
+			SELECT readings.clock_id, total_micros - total_micros %% ?1 AS bucket, COUNT(*), %[3]s
+			FROM readings JOIN kept ON kept.clock_id = readings.clock_id
+			WHERE total_micros >= kept.first
+			GROUP BY readings.clock_id, bucket
+		`, table.name, first, strings.Join(aggregates, ", ")), table.micros)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSensorAges adds the sensor reading ages. Sensors that hadn't
+// reported used to be recorded as zeros, which are replaced with nulls and
+// taken out of the rollups.
+func migrateSensorAges(tx *sql.Tx) error {
+	for _, column := range []string{"bmp180_age", "bmp390_age", "sht85_age"} {
+		if _, err := tx.Exec("ALTER TABLE readings ADD COLUMN " + column + " REAL"); err != nil {
+			return err
+		}
+	}
+
+	var cleared int64
+	for _, update := range []string{
+		"UPDATE readings SET bmp180_temperature = NULL, bmp180_pressure = NULL WHERE bmp180_pressure = 0",
+		"UPDATE readings SET bmp390_temperature = NULL, bmp390_pressure = NULL WHERE bmp390_pressure = 0",
+		"UPDATE readings SET sht85_temperature = NULL, sht85_humidity = NULL WHERE sht85_temperature = 0 AND sht85_humidity = 0",
+	} {
+		result, err := tx.Exec(update)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		cleared += n
+	}
+	if cleared == 0 {
+		return nil
+	}
+
+	log.Println("Rebuilding rollups without missing sensor values")
+	return rebuildRollupsV1(tx, true)
+}
+
+// schemaVersion returns the number of migrations applied to db, without
+// changing it.
+func schemaVersion(db *sql.DB) (int, error) {
+	names, err := columnNames(db, "schema_version")
+	if err != nil || len(names) == 0 {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err = db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	return int(version.Int64), err
+}
+
+// MigrateDatabase brings db's schema up to date, returning the migrations
+// applied. With dryRun set nothing is changed, and the migrations that
+// would be applied are returned. A database from a newer build is refused,
+// as this one can't know what its schema means.
+func MigrateDatabase(db *sql.DB, dryRun bool) ([]Migration, error) {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if version > len(migrations) {
+		return nil, fmt.Errorf("database schema version %d is newer than this build's version %d", version, len(migrations))
+	}
+
+	var pending []Migration
+	for i := version; i < len(migrations); i++ {
+		pending = append(pending, Migration{Version: i + 1, Description: migrations[i].description})
+	}
+	if dryRun || len(pending) == 0 {
+		return pending, nil
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	for n, m := range pending {
+		if err := applyMigration(db, m, migrations[m.Version-1].apply); err != nil {
+			return pending[:n], fmt.Errorf("schema migration %d (%s) failed: %v", m.Version, m.Description, err)
+		}
+		log.Printf("Applied schema migration %d: %s", m.Version, m.Description)
+	}
+	return pending, nil
+}
+
+func applyMigration(db *sql.DB, m Migration, apply func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := apply(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)",
+		m.Version, m.Description, time.Now().UnixMicro())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PendingMigrations returns the migrations that opening the database at
+// dbPath would apply, without applying them or creating the file.
+func PendingMigrations(dbPath string) ([]Migration, error) {
+	if _, err := os.Stat(dbPath); errors.Is(err, fs.ErrNotExist) {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		return MigrateDatabase(db, true)
+	}
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return MigrateDatabase(db, true)
+}
@@ -0,0 +1,267 @@
+package receiver
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// baselineSchema is the readings table as created before the schema was
+// versioned, with one reading from before the sensors had reported and
+// one from after.
+const baselineSchema = `
+	CREATE TABLE readings (
+		total_micros INTEGER PRIMARY KEY,
+		timestamp_drift INTEGER,
+		amplitude REAL,
+		period REAL,
+		bmp180_temperature REAL,
+		bmp180_pressure REAL,
+		bmp390_temperature REAL,
+		bmp390_pressure REAL,
+		sht85_temperature REAL,
+		sht85_humidity REAL
+	);
+	INSERT INTO readings VALUES (1000000, 0, 240, 1.0, 0, 0, 0, 0, 0, 0);
+	INSERT INTO readings VALUES (2000000, 0, 240, 1.0, 21.5, 1013.2, 21.4, 1013.1, 21.6, 45.0);
+`
+
+func TestMigrateDatabase(t *testing.T) {
+	newer := len(migrations) + 1
+	newerSchema := fmt.Sprintf(`
+		CREATE TABLE schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at INTEGER NOT NULL
+		);
+		INSERT INTO schema_version VALUES (%d, 'From a newer build', 0);
+	`, newer)
+
+	tests := []struct {
+		name        string
+		setup       string // SQL run before migrating
+		dryRun      bool
+		wantApplied int
+		wantVersion int
+		wantErr     bool
+	}{
+		{
+			name:        "new database",
+			wantApplied: len(migrations),
+			wantVersion: len(migrations),
+		},
+		{
+			name:        "baseline schema",
+			setup:       baselineSchema,
+			wantApplied: len(migrations),
+			wantVersion: len(migrations),
+		},
+		{
+			name:        "dry run leaves baseline schema alone",
+			setup:       baselineSchema,
+			dryRun:      true,
+			wantApplied: len(migrations),
+			wantVersion: 0,
+		},
+		{
+			name:        "newer schema is refused",
+			setup:       newerSchema,
+			wantVersion: newer,
+			wantErr:     true,
+		},
+		{
+			name:        "newer schema is refused on a dry run",
+			setup:       newerSchema,
+			dryRun:      true,
+			wantVersion: newer,
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDatabase(t)
+			if tt.setup != "" {
+				if _, err := db.Exec(tt.setup); err != nil {
+					t.Fatalf("setup: %v", err)
+				}
+			}
+
+			applied, err := MigrateDatabase(db, tt.dryRun)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MigrateDatabase() error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(applied) != tt.wantApplied {
+				t.Errorf("MigrateDatabase() returned %d migrations, want %d", len(applied), tt.wantApplied)
+			}
+			for i, m := range applied {
+				if m.Version != i+1 {
+					t.Errorf("migration %d has version %d", i, m.Version)
+				}
+			}
+
+			version, err := schemaVersion(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != tt.wantVersion {
+				t.Errorf("schema version %d, want %d", version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestMigrateBaselineReadings(t *testing.T) {
+	db := openTestDatabase(t)
+	if _, err := db.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MigrateDatabase(db, false); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := columnNames(db, "readings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, column := range []string{"clock_id", "rate", "fit_period", "impulse_energy", "bmp180_age", "sht85_age"} {
+		if !slices.Contains(names, column) {
+			t.Errorf("readings has no %s column", column)
+		}
+	}
+	tables := []string{"clock_config", "dial", "trace"}
+	for _, resolution := range rollupResolutions {
+		tables = append(tables, resolution.Table)
+	}
+	for _, table := range tables {
+		if names, err := columnNames(db, table); err != nil || len(names) == 0 {
+			t.Errorf("no %s table: %v", table, err)
+		}
+	}
+
+	// Readings are kept under the default clock, and sensor zeros from
+	// before the sensors reported become nulls
+	tests := []struct {
+		totalMicros int64
+		pressure    sql.NullFloat64
+		humidity    sql.NullFloat64
+	}{
+		{1000000, sql.NullFloat64{}, sql.NullFloat64{}},
+		{2000000, sql.NullFloat64{Float64: 1013.2, Valid: true}, sql.NullFloat64{Float64: 45.0, Valid: true}},
+	}
+	for _, tt := range tests {
+		var clockID string
+		var pressure, humidity sql.NullFloat64
+		err := db.QueryRow(`
+			SELECT clock_id, bmp180_pressure, sht85_humidity FROM readings WHERE total_micros = ?
+		`, tt.totalMicros).Scan(&clockID, &pressure, &humidity)
+		if err != nil {
+			t.Fatalf("reading %d: %v", tt.totalMicros, err)
+		}
+		if clockID != DefaultClockID {
+			t.Errorf("reading %d: clock %q, want %q", tt.totalMicros, clockID, DefaultClockID)
+		}
+		if pressure != tt.pressure || humidity != tt.humidity {
+			t.Errorf("reading %d: pressure %v and humidity %v, want %v and %v",
+				tt.totalMicros, pressure, humidity, tt.pressure, tt.humidity)
+		}
+	}
+
+	// The readings are rolled up
+	for _, resolution := range rollupResolutions {
+		var count int
+		err := db.QueryRow(fmt.Sprintf("SELECT count FROM %s WHERE clock_id = ? AND bucket_start = 0", resolution.Table),
+			DefaultClockID).Scan(&count)
+		if err != nil || count != 2 {
+			t.Errorf("%s bucket 0 has %d cycles, want 2: %v", resolution.Table, count, err)
+		}
+	}
+
+	// Migrating again has nothing to do
+	applied, err := MigrateDatabase(db, false)
+	if err != nil || len(applied) != 0 {
+		t.Errorf("second MigrateDatabase() = %v, %v, want nothing applied", applied, err)
+	}
+}
+
+// readingsColumns is the readings table as the migrations leave it.
+const readingsColumns = `
+	clock_id TEXT NOT NULL DEFAULT 'default',
+	total_micros INTEGER NOT NULL,
+	timestamp_drift INTEGER,
+	amplitude REAL,
+	period REAL,
+	beat_error REAL,
+	rate REAL,
+	rate_smoothed REAL,
+	accumulated_error REAL,
+	fit_period REAL,
+	fit_amplitude REAL,
+	fit_beat_error REAL,
+	fit_residual REAL,
+	q_factor REAL,
+	impulse_fraction REAL,
+	impulse_energy REAL,
+	unlock_time REAL,
+	drop_time REAL,
+	impulse_magnitude REAL,
+	peak_velocity REAL,
+	velocity_amplitude REAL,
+	bmp180_temperature REAL,
+	bmp180_pressure REAL,
+	bmp390_temperature REAL,
+	bmp390_pressure REAL,
+	sht85_temperature REAL,
+	sht85_humidity REAL,
+	clock_offset INTEGER,
+	clock_skew_ppm REAL,
+	position_uncertain INTEGER,
+	lost_steps INTEGER,
+	bmp180_age REAL,
+	bmp390_age REAL,
+	sht85_age REAL,
+	PRIMARY KEY (clock_id, total_micros)
+`
+
+func TestReadingsColumns(t *testing.T) {
+	var want []string
+	for _, line := range strings.Split(readingsColumns, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] != "PRIMARY" {
+			want = append(want, fields[0])
+		}
+	}
+	slices.Sort(want)
+
+	for _, setup := range []string{"", baselineSchema} {
+		db := openTestDatabase(t)
+		if _, err := db.Exec(setup); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := MigrateDatabase(db, false); err != nil {
+			t.Fatal(err)
+		}
+		names, err := columnNames(db, "readings")
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(names)
+		if !slices.Equal(names, want) {
+			t.Errorf("migrated readings columns are %v, readingsColumns has %v", names, want)
+		}
+	}
+}
+
+func openTestDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
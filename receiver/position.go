@@ -0,0 +1,114 @@
+package receiver
+
+import (
+	"log"
+	"math"
+)
+
+const (
+	rezeroSwings      = 3    // Swings to observe before re-zeroing
+	midpointRefWeight = 0.01 // Smoothing of the reference swing midpoint
+	turnMinCounts     = 3    // Turning points closer than this are jitter, not a swing
+)
+
+// A balance wheel swings symmetrically about its rest position, so the
+// midpoint between consecutive turning points shows where zero is. While
+// the position is known we track that midpoint as a reference. After steps
+// are lost we wait for a few swings, and shift the count so that their
+// midpoint lines up with the reference again. The turning points needn't
+// be either side of zero, so any offset can be recovered, but if steps are
+// lost before there's a reference the swing is assumed to be centred on
+// zero.
+
+// turningPoint is where the swing reversed.
+type turningPoint struct {
+	Direction int // 1 at a maximum, -1 at a minimum
+	Position  float64
+}
+
+// positionLost marks the position as uncertain until it can be re-zeroed.
+func (dr *DataRecorder) positionLost() {
+	if !dr.positionUncertain {
+		log.Printf("Clock %s: encoder position uncertain, waiting to re-zero", dr.clockID)
+	}
+	dr.positionUncertain = true
+	dr.rezeroMidpoints = nil
+	dr.lastTurn = nil // Turning points either side of the loss don't pair up
+	dr.resetKinematics()
+}
+
+// setTare records a new user-set zero, which re-establishes the position.
+func (dr *DataRecorder) setTare(tareOffset int) {
+	dr.tareOffset = tareOffset
+	dr.positionUncertain = false
+	dr.haveMidpointRef = false
+	dr.rezeroMidpoints = nil
+	dr.lastTurn = nil
+	dr.resetKinematics()
+}
+
+// trackPosition is called with each newly detected turning point.
+func (dr *DataRecorder) trackPosition(turn turningPoint) {
+	previous := dr.lastTurn
+	if previous != nil && previous.Direction != turn.Direction &&
+		math.Abs(turn.Position-previous.Position) < turnMinCounts*dr.geometry.DegreesPerCount() {
+		return // Jitter about a turning point, rather than a new swing
+	}
+	dr.lastTurn = &turn
+	if previous == nil || previous.Direction == turn.Direction {
+		return
+	}
+
+	midpoint := (previous.Position + turn.Position) / 2
+
+	if !dr.positionUncertain {
+		if dr.haveMidpointRef {
+			dr.midpointRef += midpointRefWeight * (midpoint - dr.midpointRef)
+		} else {
+			dr.midpointRef = midpoint
+			dr.haveMidpointRef = true
+		}
+		return
+	}
+
+	dr.rezeroMidpoints = append(dr.rezeroMidpoints, midpoint)
+	if len(dr.rezeroMidpoints) < rezeroSwings {
+		return
+	}
+
+	// With no reference yet, assume the swing is centred on zero
+	offset := median(dr.rezeroMidpoints)
+	if dr.haveMidpointRef {
+		offset -= dr.midpointRef
+	}
+	steps := dr.geometry.Counts(offset)
+	dr.countCorrection -= steps
+	dr.positionUncertain = false
+	dr.rezeroMidpoints = nil
+	dr.lastTurn = nil
+	dr.resetKinematics()
+	dr.shiftReadings(-steps)
+
+	log.Printf("Clock %s: re-zeroed encoder position by %d steps", dr.clockID, -steps)
+}
+
+// shiftReadings moves the buffered readings by a count correction, so that
+// they compare properly with the ones after it. Peaks, crossings and swing
+// fits from before the correction are forgotten, as they were found while
+// the position was uncertain.
+func (dr *DataRecorder) shiftReadings(counts int) {
+	for i := range dr.readings {
+		if dr.readings[i].TotalMicros != 0 {
+			dr.readings[i].Count += counts
+			dr.readings[i].Degrees += dr.geometry.Degrees(float64(counts))
+		}
+	}
+	dr.lastPositivePeak = nil
+	dr.lastNegativePeak = nil
+	dr.lastZeroCrossing = nil
+	dr.positiveHalfPeriod = 0
+	dr.negativeHalfPeriod = 0
+	dr.swingSamples = nil
+	dr.lastPositiveFit = nil
+	dr.lastNegativeFit = nil
+}
@@ -0,0 +1,52 @@
+package receiver
+
+import "math"
+
+const secondsPerDay = 86400
+
+// rateTracker computes a clock's rate in seconds per day from each cycle's
+// period, along with an exponentially smoothed rate.
+type rateTracker struct {
+	smoothed   float64
+	valid      bool
+	lastMicros uint64
+}
+
+// update fills in the rate fields of cycle. They are left nil if the clock
+// has no nominal period.
+func (rt *rateTracker) update(cycle *HistoricalData, config ClockConfig) {
+	nominal := config.Period()
+	if nominal <= 0 || cycle.Period <= 0 {
+		return
+	}
+	rate := (nominal/cycle.Period - 1) * secondsPerDay
+	cycle.Rate = &rate
+
+	// Cycles measured while the position was in doubt may be far out, so
+	// keep them out of the average
+	if cycle.PositionUncertain {
+		if rt.valid {
+			smoothed := rt.smoothed
+			cycle.RateSmoothed = &smoothed
+		}
+		return
+	}
+
+	// Start afresh after a gap, when the old average no longer applies
+	elapsed := float64(cycle.TotalMicros-rt.lastMicros) / 1e6
+	if !rt.valid || elapsed > 10*nominal || config.RateSmoothing <= 0 {
+		rt.smoothed = rate
+		rt.valid = true
+	} else {
+		weight := 1 - math.Exp(-elapsed/config.RateSmoothing)
+		rt.smoothed += weight * (rate - rt.smoothed)
+	}
+	rt.lastMicros = cycle.TotalMicros
+
+	smoothed := rt.smoothed
+	cycle.RateSmoothed = &smoothed
+}
+
+func (rt *rateTracker) reset() {
+	rt.valid = false
+}
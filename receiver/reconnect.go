@@ -0,0 +1,112 @@
+package receiver
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// portIdentity identifies a USB serial adapter independently of the device
+// path it happens to be enumerated under.
+type portIdentity struct {
+	VID          string
+	PID          string
+	SerialNumber string
+}
+
+// lookupPortIdentity returns the USB identity of the port tc refers to, or
+// nil if it isn't a USB serial port.
+func lookupPortIdentity(tc TransportConfig) *portIdentity {
+	if tc.Type != "" && tc.Type != TransportSerial {
+		return nil
+	}
+
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return nil
+	}
+	for _, port := range ports {
+		if port.Name == tc.PortName && port.IsUSB {
+			return &portIdentity{
+				VID:          port.VID,
+				PID:          port.PID,
+				SerialNumber: port.SerialNumber,
+			}
+		}
+	}
+	return nil
+}
+
+// resolvePort works out where a serial device has reappeared after being
+// unplugged, since it may come back as e.g. /dev/ttyUSB1 instead of
+// /dev/ttyUSB0. Network transports are returned unchanged.
+func resolvePort(tc TransportConfig, id *portIdentity) TransportConfig {
+	if tc.Type != "" && tc.Type != TransportSerial {
+		return tc
+	}
+
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return tc
+	}
+
+	// Prefer the same adapter, wherever it is now
+	if id != nil {
+		for _, port := range ports {
+			if port.IsUSB && port.VID == id.VID && port.PID == id.PID && port.SerialNumber == id.SerialNumber {
+				tc.PortName = port.Name
+				return tc
+			}
+		}
+	}
+
+	// Otherwise keep the old path. Guessing at another port could open a
+	// different clock's adapter.
+	return tc
+}
+
+// reconnect keeps trying to reopen a failed connection with exponential
+// backoff, until it succeeds or the connection generation changes because
+// someone connected to something else.
+func (c *Clock) reconnect(gen int, tc TransportConfig) {
+	delay := c.server.config.ReconnectMinDelay
+	for attempt := 1; ; attempt++ {
+		c.statusChan <- StatusMessage{
+			Device: DeviceTypeSerial,
+			Status: StatusReconnecting,
+			Error:  fmt.Sprintf("Attempt %d in %v", attempt, delay),
+		}
+		time.Sleep(delay)
+
+		c.serialMux.Lock()
+		if c.connGen != gen {
+			c.serialMux.Unlock()
+			return
+		}
+
+		target := resolvePort(tc, c.portIdentity)
+		transport, err := c.openTransport(target)
+		if err == nil {
+			c.lastTransport = &target
+			c.startReader(transport)
+			c.serialMux.Unlock()
+			log.Printf("Clock %s: reconnected to %s after %d attempts", c.ID, target, attempt)
+			return
+		}
+		c.serialMux.Unlock()
+
+		log.Printf("Clock %s: reconnect attempt %d to %s failed: %v", c.ID, attempt, target, err)
+		c.statusChan <- StatusMessage{
+			Device: DeviceTypeSerial,
+			Status: StatusError,
+			Error:  err.Error(),
+		}
+
+		delay *= 2
+		if delay > c.server.config.ReconnectMaxDelay {
+			delay = c.server.config.ReconnectMaxDelay
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package receiver
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	pruneInterval = time.Hour
+	pruneBatch    = 10000 // Rows deleted per statement, so writers aren't locked out for long
+)
+
+// Each class of data has its own retention: the raw trace, which is large
+// and only useful for looking closely at recent swings; the per-cycle
+// readings; and the rollups, which are small enough to keep for years. A
+// retention of zero keeps the data forever.
+//
+// Readings are pruned a whole day at a time, so that every rollup bucket
+// is either still backed by all of its readings or none of them, and can
+// be rebuilt from what's left.
+
+// TableStats describes one table's share of the database.
+type TableStats struct {
+	Name   string `json:"name"`
+	Rows   int64  `json:"rows"`
+	Oldest *int64 `json:"oldest"` // Time of the oldest row in micros, null if empty
+}
+
+// StorageStats describes the database's size and contents.
+type StorageStats struct {
+	SizeBytes int64        `json:"size_bytes"`
+	FreeBytes int64        `json:"free_bytes"` // Unused pages awaiting incremental vacuum
+	Tables    []TableStats `json:"tables"`
+
+	TraceRetention    float64 `json:"trace_retention"` // Seconds, 0 for forever
+	ReadingsRetention float64 `json:"readings_retention"`
+	RollupRetention   float64 `json:"rollup_retention"`
+
+	Writer DBWriterStats `json:"writer"`
+}
+
+// timedTables lists each table with the column holding its rows' times.
+var timedTables = []struct{ name, column string }{
+	{"readings", "total_micros"},
+	{"trace", "start_micros"},
+	{"rollup_1m", "bucket_start"},
+	{"rollup_1h", "bucket_start"},
+	{"rollup_1d", "bucket_start"},
+}
+
+// pruneDatabase deletes rows older than their retention allows at now, and
+// returns the freed pages to the filesystem.
+func pruneDatabase(db *sql.DB, config Config, now time.Time) error {
+	ids, err := ClockIDs(db)
+	if err != nil {
+		return err
+	}
+
+	var deleted int64
+	prune := func(table, column string, retention time.Duration, align int64) error {
+		if retention <= 0 {
+			return nil
+		}
+		cutoff := now.Add(-retention).UnixMicro()
+		cutoff -= cutoff % align
+		for _, id := range ids {
+			n, err := deleteBefore(db, table, column, id, cutoff)
+			deleted += n
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	day := rollupResolutions[len(rollupResolutions)-1].Micros
+	if err := prune("trace", "host_end", config.TraceRetention, 1); err != nil {
+		return err
+	}
+	if err := prune("readings", "total_micros", config.ReadingsRetention, day); err != nil {
+		return err
+	}
+	for _, resolution := range rollupResolutions {
+		if err := prune(resolution.Table, "bucket_start", config.RollupRetention, 1); err != nil {
+			return err
+		}
+	}
+
+	if deleted > 0 {
+		log.Printf("Pruned %d rows from the database", deleted)
+	}
+	return incrementalVacuum(db)
+}
+
+// incrementalVacuum frees every unused page. The pragma frees a page per
+// step, so it has to be read to the end.
+func incrementalVacuum(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA incremental_vacuum")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+// deleteBefore deletes clockID's rows of table with column before cutoff,
+// in batches, returning how many were deleted.
+func deleteBefore(db *sql.DB, table, column, clockID string, cutoff int64) (int64, error) {
+	var total int64
+	for {
+		result, err := db.Exec(fmt.Sprintf(`
+			DELETE FROM %[1]s WHERE rowid IN (
+				SELECT rowid FROM %[1]s WHERE clock_id = ? AND %[2]s < ? LIMIT ?
+			)
+		`, table, column), clockID, cutoff, pruneBatch)
+		if err != nil {
+			return total, err
+		}
+		n, err := result.RowsAffected()
+		total += n
+		if err != nil || n < pruneBatch {
+			return total, err
+		}
+	}
+}
+
+// autoVacuumIncremental is the auto_vacuum pragma's value for incremental
+// mode.
+const autoVacuumIncremental = 2
+
+// autoVacuumMode returns db's auto_vacuum pragma.
+func autoVacuumMode(db *sql.DB) (int, error) {
+	var mode int
+	err := db.QueryRow("PRAGMA auto_vacuum").Scan(&mode)
+	return mode, err
+}
+
+// EnableIncrementalVacuum switches a database to incremental auto-vacuum,
+// which lets pruning give space back without rewriting the whole file. A
+// database created before it was enabled has to be vacuumed once to
+// switch, which rewrites the whole file and needs as much free space
+// again, so it's only done when asked for. The connection is expected to
+// ask for incremental mode, so that a new database starts in it.
+func EnableIncrementalVacuum(db *sql.DB) error {
+	mode, err := autoVacuumMode(db)
+	if err != nil || mode == autoVacuumIncremental {
+		return err
+	}
+	log.Println("Vacuuming database to enable incremental vacuum, this may take a while")
+	_, err = db.Exec("VACUUM")
+	return err
+}
+
+// GetStorageStats reports the database's size, and the row count and
+// oldest row of each table.
+func GetStorageStats(db *sql.DB, config Config) (StorageStats, error) {
+	stats := StorageStats{
+		TraceRetention:    config.TraceRetention.Seconds(),
+		ReadingsRetention: config.ReadingsRetention.Seconds(),
+		RollupRetention:   config.RollupRetention.Seconds(),
+	}
+
+	var pageSize, pageCount, freePages int64
+	for _, pragma := range []struct {
+		name  string
+		value *int64
+	}{
+		{"page_size", &pageSize},
+		{"page_count", &pageCount},
+		{"freelist_count", &freePages},
+	} {
+		if err := db.QueryRow("PRAGMA " + pragma.name).Scan(pragma.value); err != nil {
+			return stats, err
+		}
+	}
+	stats.SizeBytes = pageSize * pageCount
+	stats.FreeBytes = pageSize * freePages
+
+	ids, err := ClockIDs(db)
+	if err != nil {
+		return stats, err
+	}
+	for _, table := range timedTables {
+		ts := TableStats{Name: table.name}
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table.name).Scan(&ts.Rows); err != nil {
+			return stats, err
+		}
+		// Per clock, so the primary key's index finds each oldest row
+		for _, id := range ids {
+			var oldest sql.NullInt64
+			err := db.QueryRow(fmt.Sprintf("SELECT MIN(%s) FROM %s WHERE clock_id = ?", table.column, table.name), id).Scan(&oldest)
+			if err != nil {
+				return stats, err
+			}
+			if oldest.Valid && (ts.Oldest == nil || oldest.Int64 < *ts.Oldest) {
+				ts.Oldest = &oldest.Int64
+			}
+		}
+		stats.Tables = append(stats.Tables, ts)
+	}
+	return stats, nil
+}
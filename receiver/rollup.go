@@ -0,0 +1,235 @@
+package receiver
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Rollups summarize the readings table at coarser resolutions, so that
+// long ranges can be queried quickly and old readings pruned without
+// losing the long-term record. Each table has a row per clock per bucket
+// of total_micros, aligned to the Unix epoch, holding the count, sum, sum
+// of squares, minimum and maximum of each column. Those can be added to
+// one cycle at a time as it's recorded, and the mean and standard
+// deviation worked out when queried.
+
+// RollupResolution is one of the rollup tables.
+type RollupResolution struct {
+	Name   string // As given in queries
+	Table  string
+	Micros int64 // Bucket width
+}
+
+var rollupResolutions = []RollupResolution{
+	{"1m", "rollup_1m", 60 * 1000000},
+	{"1h", "rollup_1h", 3600 * 1000000},
+	{"1d", "rollup_1d", 86400 * 1000000},
+}
+
+// rollupColumns are the readings columns summarized in the rollups.
+var rollupColumns = []string{
+	"period",
+	"amplitude",
+	"rate",
+	"bmp180_temperature",
+	"bmp180_pressure",
+	"bmp390_temperature",
+	"bmp390_pressure",
+	"sht85_temperature",
+	"sht85_humidity",
+}
+
+// rollupValues returns the cycle's values of rollupColumns, nil where a
+// value is missing.
+func rollupValues(cycle *HistoricalData) []*float64 {
+	return []*float64{
+		&cycle.Period,
+		&cycle.Amplitude,
+		cycle.Rate,
+		cycle.BMP180Temperature,
+		cycle.BMP180Pressure,
+		cycle.BMP390Temperature,
+		cycle.BMP390Pressure,
+		cycle.SHT85Temperature,
+		cycle.SHT85Humidity,
+	}
+}
+
+// Rollup is one bucket of a rollup table.
+type Rollup struct {
+	Start   int64                    `json:"start"` // total_micros at the start of the bucket
+	Count   int                      `json:"count"` // Cycles in the bucket
+	Columns map[string]ColumnSummary `json:"columns"`
+}
+
+// FindRollupResolution returns the resolution with the given name.
+func FindRollupResolution(name string) (RollupResolution, bool) {
+	for _, resolution := range rollupResolutions {
+		if resolution.Name == name {
+			return resolution, true
+		}
+	}
+	return RollupResolution{}, false
+}
+
+// rollupUpsert returns the statement adding one cycle to a rollup table.
+// Its parameters are the clock, the bucket start, then the count, sum, sum
+// of squares, minimum and maximum of each column.
+func rollupUpsert(table string) string {
+	names := []string{"clock_id", "bucket_start", "count"}
+	values := []string{"?", "?", "1"}
+	updates := []string{"count = count + 1"}
+	for _, column := range rollupColumns {
+		names = append(names, column+"_count", column+"_sum", column+"_sum_sq", column+"_min", column+"_max")
+		values = append(values, "?", "?", "?", "?", "?")
+		updates = append(updates,
+			fmt.Sprintf("%[1]s_count = %[1]s_count + excluded.%[1]s_count", column),
+			fmt.Sprintf("%[1]s_sum = %[1]s_sum + excluded.%[1]s_sum", column),
+			fmt.Sprintf("%[1]s_sum_sq = %[1]s_sum_sq + excluded.%[1]s_sum_sq", column),
+			// MIN and MAX of a NULL are NULL, so a missing value on either
+			// side defers to the other
+			fmt.Sprintf("%[1]s_min = MIN(COALESCE(%[1]s_min, excluded.%[1]s_min), COALESCE(excluded.%[1]s_min, %[1]s_min))", column),
+			fmt.Sprintf("%[1]s_max = MAX(COALESCE(%[1]s_max, excluded.%[1]s_max), COALESCE(excluded.%[1]s_max, %[1]s_max))", column),
+		)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (clock_id, bucket_start) DO UPDATE SET %s",
+		table, strings.Join(names, ", "), strings.Join(values, ", "), strings.Join(updates, ", "))
+}
+
+// addToRollups adds a newly recorded cycle to every rollup table.
+func addToRollups(tx *sql.Tx, clockID string, cycle *HistoricalData) error {
+	var args []any
+	for _, value := range rollupValues(cycle) {
+		if value == nil {
+			args = append(args, 0, 0.0, 0.0, nil, nil)
+		} else {
+			v := *value
+			args = append(args, 1, v, v*v, v, v)
+		}
+	}
+	micros := int64(cycle.TotalMicros)
+	for _, resolution := range rollupResolutions {
+		start := micros - micros%resolution.Micros
+		params := append([]any{clockID, start}, args...)
+		if _, err := tx.Exec(rollupUpsert(resolution.Table), params...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RebuildRollups recomputes the rollup buckets overlapping startTime to
+// endTime from the readings table. Buckets from before the oldest reading
+// kept may have had readings pruned from them, so they're left as they
+// are, as is the range past the newest reading.
+func (dr *DataRecorder) RebuildRollups(startTime, endTime int64) error {
+	tx, err := dr.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	oldest, newest, ok, err := readingsSpan(tx, dr.clockID)
+	if err != nil || !ok {
+		return err
+	}
+	endTime = min(endTime, newest)
+	if startTime > endTime {
+		return nil
+	}
+	if err := rebuildRollups(tx, dr.clockID, startTime, endTime, oldest); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// rebuildRollups recomputes the rollup buckets overlapping startTime to
+// endTime, except those starting before kept, the earliest time whose
+// readings are all still in the readings table.
+func rebuildRollups(tx *sql.Tx, clockID string, startTime, endTime, kept int64) error {
+	var aggregates []string
+	for _, column := range rollupColumns {
+		aggregates = append(aggregates, fmt.Sprintf(
+			"COUNT(%[1]s), TOTAL(%[1]s), TOTAL(%[1]s * %[1]s), MIN(%[1]s), MAX(%[1]s)", column))
+	}
+
+	for _, resolution := range rollupResolutions {
+		first := startTime - startTime%resolution.Micros
+		if first < kept {
+			first = kept - kept%resolution.Micros
+			if first < kept {
+				first += resolution.Micros
+			}
+		}
+		last := endTime - endTime%resolution.Micros + resolution.Micros - 1
+		if first > last {
+			continue
+		}
+		_, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE clock_id = ? AND bucket_start BETWEEN ? AND ?", resolution.Table),
+			clockID, first, last)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf(`
+			INSERT INTO %s
+			SELECT clock_id, total_micros - total_micros %% ?1 AS bucket, COUNT(*), %s
+			FROM readings
+			WHERE clock_id = ?2 AND total_micros BETWEEN ?3 AND ?4
+			GROUP BY bucket
+		`, resolution.Table, strings.Join(aggregates, ", ")), resolution.Micros, clockID, first, last)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRollups returns the buckets of the given resolution starting between
+// startTime and endTime.
+func (dr *DataRecorder) GetRollups(resolution RollupResolution, startTime, endTime int64) ([]Rollup, error) {
+	var columns []string
+	for _, column := range rollupColumns {
+		columns = append(columns, fmt.Sprintf("%[1]s_count, %[1]s_sum, %[1]s_sum_sq, %[1]s_min, %[1]s_max", column))
+	}
+	rows, err := dr.db.Query(fmt.Sprintf(`
+		SELECT bucket_start, count, %s
+		FROM %s
+		WHERE clock_id = ? AND bucket_start BETWEEN ? AND ?
+		ORDER BY bucket_start ASC
+	`, strings.Join(columns, ", "), resolution.Table), dr.clockID, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rollups []Rollup
+	for rows.Next() {
+		rollup := Rollup{Columns: make(map[string]ColumnSummary, len(rollupColumns))}
+		counts := make([]int, len(rollupColumns))
+		sums := make([]float64, 2*len(rollupColumns))
+		extremes := make([]sql.NullFloat64, 2*len(rollupColumns))
+		dest := []any{&rollup.Start, &rollup.Count}
+		for i := range rollupColumns {
+			dest = append(dest, &counts[i], &sums[2*i], &sums[2*i+1], &extremes[2*i], &extremes[2*i+1])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		for i, column := range rollupColumns {
+			summary := ColumnSummary{Count: counts[i]}
+			if summary.Count > 0 {
+				n := float64(summary.Count)
+				summary.Mean = sums[2*i] / n
+				summary.StdDev = math.Sqrt(math.Max(0, sums[2*i+1]/n-summary.Mean*summary.Mean))
+				summary.Min = extremes[2*i].Float64
+				summary.Max = extremes[2*i+1].Float64
+			}
+			rollup.Columns[column] = summary
+		}
+		rollups = append(rollups, rollup)
+	}
+	return rollups, rows.Err()
+}
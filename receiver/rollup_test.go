@@ -0,0 +1,70 @@
+package receiver
+
+import "testing"
+
+func TestRebuildRollupsKeepsPrunedBuckets(t *testing.T) {
+	db := openTestDatabase(t)
+	if _, err := MigrateDatabase(db, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cycle a minute over two days, whose rollups were built before the
+	// first day's readings were pruned, along with the first 30 minutes of
+	// the second day
+	const minute = 60 * 1000000
+	const day = 1440 * minute
+	for i := int64(0); i < 2880; i++ {
+		_, err := db.Exec("INSERT INTO readings (clock_id, total_micros, amplitude, period) VALUES (?, ?, 240, 1.0)",
+			DefaultClockID, i*minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dr := NewDataRecorder(db, DefaultClockID)
+	if err := dr.RebuildRollups(0, 2*day); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("DELETE FROM readings WHERE total_micros < ?", day+30*minute); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		start    int64
+		end      int64
+		wantDays []int // Cycles in each day's bucket
+	}{
+		{"whole range", 0, 2 * day, []int{1440, 1440}},
+		{"from the Unix epoch", 0, 0, []int{1440, 1440}},
+		{"past the newest reading", 0, 1 << 62, []int{1440, 1440}},
+		{"kept readings", day + 30*minute, 2 * day, []int{1440, 1440}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := dr.RebuildRollups(tt.start, tt.end); err != nil {
+				t.Fatal(err)
+			}
+
+			days, err := dr.GetRollups(rollupResolutions[2], 0, 2*day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(days) != len(tt.wantDays) {
+				t.Fatalf("%d day buckets, want %d", len(days), len(tt.wantDays))
+			}
+			for i, want := range tt.wantDays {
+				if days[i].Count != want {
+					t.Errorf("day %d has %d cycles, want %d", i, days[i].Count, want)
+				}
+			}
+
+			minutes, err := dr.GetRollups(rollupResolutions[0], 0, 2*day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(minutes) != 2880 {
+				t.Errorf("%d minute buckets, want 2880", len(minutes))
+			}
+		})
+	}
+}
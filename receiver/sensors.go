@@ -0,0 +1,145 @@
+package receiver
+
+import (
+	"sort"
+	"time"
+)
+
+// DefaultSensorMaxAge is how far a sensor reading can be from a cycle and
+// still be recorded with it.
+const DefaultSensorMaxAge = 10 * time.Second
+
+// The environmental sensors are read every couple of seconds, so a cycle
+// usually falls between two readings. Its sensor values are interpolated
+// between them, which means waiting for the sensors to report after the
+// cycle before it can be written. A sensor whose last reading before a
+// cycle is older than the maximum age is taken to be dead, and gives null
+// values rather than stale ones.
+
+// sensorSample is one reading from a sensor.
+type sensorSample struct {
+	time   int64      // Host micros
+	values [2]float64 // Temperature, then pressure or humidity
+}
+
+// sensorHistory holds a sensor's recent samples, oldest first.
+type sensorHistory struct {
+	samples []sensorSample
+}
+
+func (h *sensorHistory) add(sample sensorSample) {
+	if n := len(h.samples); n > 0 && sample.time <= h.samples[n-1].time {
+		return // Out of order
+	}
+	h.samples = append(h.samples, sample)
+}
+
+// trim drops the samples that aren't needed for times from t on.
+func (h *sensorHistory) trim(t int64) {
+	i := sort.Search(len(h.samples), func(i int) bool { return h.samples[i].time > t })
+	if i > 1 {
+		h.samples = append(h.samples[:0], h.samples[i-1:]...)
+	}
+}
+
+// at returns the sensor's values at host time t, interpolated between the
+// samples either side, and the age in seconds of the one before. values
+// and age are nil if there's no sample within maxAge before t. If there's
+// no sample after t yet, ok is false until now is maxAge past t, as one
+// may still come; the sample before is returned alone meanwhile.
+func (h *sensorHistory) at(t, now int64, maxAge time.Duration) (values *[2]float64, age *float64, ok bool) {
+	limit := maxAge.Microseconds()
+	i := sort.Search(len(h.samples), func(i int) bool { return h.samples[i].time > t })
+	if i == 0 || t-h.samples[i-1].time > limit {
+		return nil, nil, true
+	}
+	before := h.samples[i-1]
+	v := before.values
+	a := float64(t-before.time) / 1e6
+
+	if i == len(h.samples) {
+		return &v, &a, now-t > limit
+	}
+	if after := h.samples[i]; after.time-t <= limit {
+		f := float64(t-before.time) / float64(after.time-before.time)
+		for j := range v {
+			v[j] += f * (after.values[j] - before.values[j])
+		}
+	}
+	return &v, &a, true
+}
+
+// SetSensorMaxAge sets how far a sensor reading can be from a cycle and
+// still be recorded with it.
+func (dr *DataRecorder) SetSensorMaxAge(maxAge time.Duration) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	dr.sensorMaxAge = maxAge
+}
+
+func (dr *DataRecorder) UpdateBMP180(reading BMP180Reading) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	dr.bmp180.add(sensorSample{reading.Timestamp, [2]float64{reading.Temperature, reading.Pressure}})
+	dr.trimSensors(reading.Timestamp)
+}
+
+func (dr *DataRecorder) UpdateBMP390(reading BMP390Reading) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	dr.bmp390.add(sensorSample{reading.Timestamp, [2]float64{reading.Temperature, reading.Pressure}})
+	dr.trimSensors(reading.Timestamp)
+}
+
+func (dr *DataRecorder) UpdateSHT85(reading SHT85Reading) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	dr.sht85.add(sensorSample{reading.Timestamp, [2]float64{reading.Temperature, reading.Humidity}})
+	dr.trimSensors(reading.Timestamp)
+}
+
+// writeCycles writes the cycles waiting for sensor readings, in order, as
+// far as the first that's still waiting at host time now. With flush set
+// none wait.
+func (dr *DataRecorder) writeCycles(now int64, flush bool) {
+	n := 0
+	for ; n < len(dr.unwritten); n++ {
+		cycle := dr.unwritten[n]
+		t := int64(cycle.TotalMicros) + cycle.ClockOffset
+		bmp180, bmp180Age, ok180 := dr.bmp180.at(t, now, dr.sensorMaxAge)
+		bmp390, bmp390Age, ok390 := dr.bmp390.at(t, now, dr.sensorMaxAge)
+		sht85, sht85Age, ok85 := dr.sht85.at(t, now, dr.sensorMaxAge)
+		if !(ok180 && ok390 && ok85) && !flush {
+			break
+		}
+
+		if bmp180 != nil {
+			cycle.BMP180Temperature, cycle.BMP180Pressure = &bmp180[0], &bmp180[1]
+		}
+		if bmp390 != nil {
+			cycle.BMP390Temperature, cycle.BMP390Pressure = &bmp390[0], &bmp390[1]
+		}
+		if sht85 != nil {
+			cycle.SHT85Temperature, cycle.SHT85Humidity = &sht85[0], &sht85[1]
+		}
+		cycle.BMP180Age, cycle.BMP390Age, cycle.SHT85Age = bmp180Age, bmp390Age, sht85Age
+		dr.writeToDatabase(cycle)
+	}
+	dr.unwritten = append(dr.unwritten[:0], dr.unwritten[n:]...)
+	dr.trimSensors(now)
+}
+
+// trimSensors drops the sensor samples that no cycle still to be written
+// can use. A clock that isn't producing cycles still gets every sample, so
+// this is done as they arrive as well as when cycles are written. Cycles
+// yet to come can be a little behind host time now, so samples are kept
+// back to the maximum age before it.
+func (dr *DataRecorder) trimSensors(now int64) {
+	oldest := now - dr.sensorMaxAge.Microseconds()
+	if len(dr.unwritten) > 0 {
+		oldest = min(oldest, int64(dr.unwritten[0].TotalMicros)+dr.unwritten[0].ClockOffset)
+	}
+	dr.bmp180.trim(oldest)
+	dr.bmp390.trim(oldest)
+	dr.sht85.trim(oldest)
+}
@@ -0,0 +1,31 @@
+package receiver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSensorHistoryBoundedWithoutCycles(t *testing.T) {
+	db := openTestDatabase(t)
+	if _, err := MigrateDatabase(db, false); err != nil {
+		t.Fatal(err)
+	}
+	dr := NewDataRecorder(db, DefaultClockID)
+
+	// An hour of samples every two seconds, with no readings at all
+	const interval = 2 * time.Second
+	maxSamples := int(DefaultSensorMaxAge/interval) + 2
+	start := time.Now().UnixMicro()
+	for i := int64(0); i < 1800; i++ {
+		now := start + i*interval.Microseconds()
+		dr.UpdateBMP180(BMP180Reading{Timestamp: now, Temperature: 21, Pressure: 1013})
+		dr.UpdateBMP390(BMP390Reading{Timestamp: now, Temperature: 21, Pressure: 1013})
+		dr.UpdateSHT85(SHT85Reading{Timestamp: now, Temperature: 21, Humidity: 45})
+	}
+
+	for name, history := range map[string]*sensorHistory{"bmp180": &dr.bmp180, "bmp390": &dr.bmp390, "sht85": &dr.sht85} {
+		if n := len(history.samples); n == 0 || n > maxSamples {
+			t.Errorf("%s history has %d samples, want 1 to %d", name, n, maxSamples)
+		}
+	}
+}
@@ -1,13 +1,13 @@
 package receiver
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"sync/atomic"
 	"time"
-
-	"go.bug.st/serial"
 )
 
 const (
@@ -16,43 +16,110 @@ const (
 	StatusDisconnected = "DISCONNECTED"
 	StatusConnected    = "CONNECTED"
 	StatusOverflow     = "OVERFLOW"
+	StatusResync       = "RESYNC"
+	StatusSequenceGap  = "SEQUENCE_GAP"
+	StatusReconnecting = "RECONNECTING"
 	StatusError        = "ERROR"
 )
 
+var errReaderClosed = errors.New("reader closed")
+
 type Reading struct {
-	TotalMicros uint64 `json:"TotalMicros"`
-	Count       int    `json:"Count"`
-	TimestampDrift  int64  `json:"TimestampDrift"`
+	ClockID        string  `json:"ClockID"`
+	TotalMicros    uint64  `json:"TotalMicros"`
+	Count          int     `json:"Count"`
+	TimestampDrift int64   `json:"TimestampDrift"`
+	ClockOffset    int64   `json:"ClockOffset"` // TimestampDrift according to the clock skew fit
+	SkewPPM        float64 `json:"SkewPPM"`
+	LostSteps      uint64  `json:"LostSteps"` // Steps known to be lost since the reader started
+	Degrees        float64 `json:"Degrees"`   // Balance angle of Count, filled in by DataRecorder
+
+	// PositionUncertain is set by SerialReader when steps may have been
+	// lost just before this reading, and by DataRecorder while the position
+	// hasn't yet been re-established.
+	PositionUncertain bool `json:"PositionUncertain,omitempty"`
 }
 
 type StatusMessage struct {
-	Device string `json:"Device"`
-	Status string `json:"Status"`
-	Error  string `json:"Error,omitempty"`
+	Device  string `json:"Device"`
+	ClockID string `json:"ClockID,omitempty"`
+	Status  string `json:"Status"`
+	Error   string `json:"Error,omitempty"`
 }
 
 type SerialReader struct {
-	port              serial.Port
+	port              Transport
 	buffer            []byte
+	decoder           *FrameDecoder
 	lastTimestamp     uint32
 	overflowCount     uint64
 	count             int
 	consecutiveErrors int
 	statusChan        chan StatusMessage
 	done              chan struct{}
-	timeOffset        int64    // Unix epoch microseconds when first reading received
-	firstTimestamp    uint64   // First device timestamp in microseconds
+	stopping          atomic.Bool
+	timeOffset        int64  // Unix epoch microseconds when first reading received
+	firstTimestamp    uint64 // First device timestamp in microseconds
+	lastReadingTime   int64  // Host time of the last reading in Unix micros
+	skew              *ClockSkewEstimator
+	version           int // Protocol version of the frames seen so far
+	haveSequence      bool
+	lastSequence      uint16
+	lostSteps         uint64 // Steps lost to overflows and sequence gaps
+	positionLost      bool   // Steps may have been lost since the last reading
+	stats             *LinkStats
+	now               func() int64
 }
 
-func NewSerialReader(port serial.Port, statusChan chan StatusMessage) *SerialReader {
+func NewSerialReader(port Transport, statusChan chan StatusMessage) *SerialReader {
 	return &SerialReader{
-		port:       port,
-		buffer:     make([]byte, 5),
-		statusChan: statusChan,
-		done:       make(chan struct{}),
+		port:    port,
+		buffer:  make([]byte, 256),
+		decoder: NewFrameDecoder(),
+		skew:    NewClockSkewEstimator(),
+		stats:   NewLinkStats(),
+		// The count starts from wherever the wheel happens to be
+		positionLost: true,
+		statusChan:   statusChan,
+		done:         make(chan struct{}),
+		now:          func() int64 { return time.Now().UnixMicro() },
 	}
 }
 
+// SetClock replaces the host clock used to timestamp received bytes, e.g.
+// with ReplayPort.Now so replayed data keeps its recorded times.
+func (sr *SerialReader) SetClock(now func() int64) {
+	sr.now = now
+}
+
+// SetStats replaces the reader's link statistics, so that totals can be
+// kept across several readers.
+func (sr *SerialReader) SetStats(stats *LinkStats) {
+	sr.stats = stats
+}
+
+// Stats returns the reader's link statistics.
+func (sr *SerialReader) Stats() *LinkStats {
+	return sr.stats
+}
+
+// Done is closed once StartReading has returned.
+func (sr *SerialReader) Done() <-chan struct{} {
+	return sr.done
+}
+
+// ClockSkew returns the current estimate of the device clock's skew.
+func (sr *SerialReader) ClockSkew() ClockSkew {
+	return sr.skew.Estimate()
+}
+
+// Close stops the reader deliberately. Unlike a read failure this doesn't
+// report any errors.
+func (sr *SerialReader) Close() {
+	sr.stopping.Store(true)
+	sr.port.Close()
+}
+
 func (sr *SerialReader) StartReading(readings chan<- Reading) {
 	// Notify that serial reading has started
 	sr.statusChan <- StatusMessage{
@@ -63,19 +130,18 @@ func (sr *SerialReader) StartReading(readings chan<- Reading) {
 	const maxConsecutiveErrors = 10
 	defer func() {
 		sr.port.Close()
-		close(sr.done)
 		sr.statusChan <- StatusMessage{
 			Device: DeviceTypeSerial,
 			Status: StatusDisconnected,
 		}
+		close(sr.done)
 	}()
 
-	var lastReadingTime int64 // Track the last reading time in Unix micros
-
 	for {
 		if sr.consecutiveErrors >= maxConsecutiveErrors {
 			errMsg := fmt.Sprintf("Too many consecutive read errors (%d), disconnecting", sr.consecutiveErrors)
 			log.Println(errMsg)
+			sr.stats.errorDisconnects.Add(1)
 			sr.statusChan <- StatusMessage{
 				Device: DeviceTypeSerial,
 				Status: StatusError,
@@ -84,67 +150,118 @@ func (sr *SerialReader) StartReading(readings chan<- Reading) {
 			return // This will trigger the deferred cleanup
 		}
 
-		timestamp, direction, currentTime, ok := sr.readAndValidatePacket()
-		if !ok {
+		currentTime, err := sr.readChunk()
+		if err == errReaderClosed {
+			return
+		}
+		if err == io.EOF {
+			log.Println("Serial stream ended")
+			return
+		}
+		if err != nil {
 			continue
 		}
 
-		// Initialize time offset on first reading
-		if sr.timeOffset == 0 {
-			sr.timeOffset = currentTime
-			sr.firstTimestamp = uint64(timestamp)
-		} else {
-			// Check if more than 60 seconds have elapsed since last reading
-			if currentTime-lastReadingTime > 60*1000000 {
-				// Resync the time offset
-				sr.timeOffset = currentTime
-				sr.firstTimestamp = uint64(timestamp)
-				sr.overflowCount = 0 // Reset overflow count with new sync
-				log.Printf("Resyncing time offset due to >60s gap between readings")
+		checksumFailures := sr.decoder.ChecksumFailures()
+		for {
+			frame, skipped, ok := sr.decoder.Next()
+			if skipped > 0 {
+				sr.stats.resyncs.Add(1)
+				log.Printf("Resynchronized frame stream, skipped %d bytes", skipped)
+				sr.statusChan <- StatusMessage{
+					Device: DeviceTypeSerial,
+					Status: StatusResync,
+					Error:  fmt.Sprintf("Skipped %d bytes", skipped),
+				}
 			}
-		}
-		lastReadingTime = currentTime
-
-		// Handle timestamp overflow
-		if timestamp < sr.lastTimestamp {
-			sr.overflowCount++
-			log.Printf("Timestamp overflow detected! Count: %d", sr.overflowCount)
-			sr.statusChan <- StatusMessage{
-				Device: DeviceTypeSerial,
-				Status: StatusOverflow,
-				Error:  fmt.Sprintf("Overflow count: %d", sr.overflowCount),
+			if !ok {
+				break
+			}
+			sr.stats.frames.Add(1)
+			if skipped > 0 && frame.Version == 1 {
+				// Without sequence numbers we can't tell how many steps the
+				// skipped bytes held
+				sr.positionLost = true
 			}
-		}
-		sr.lastTimestamp = timestamp
 
-		// Calculate device microseconds since first reading
-		deviceMicros := uint64(timestamp) + (sr.overflowCount * 0xFFFFFFFF) - sr.firstTimestamp
+			if frame.Version != sr.version {
+				log.Printf("Encoder is using protocol v%d", frame.Version)
+				sr.version = frame.Version
+				sr.haveSequence = false
+			}
+			if frame.Version == 2 && !sr.checkSequence(frame.Sequence) {
+				continue
+			}
 
-		// Calculate actual Unix epoch microseconds
-		totalMicros := sr.timeOffset + int64(deviceMicros)
+			if frame.Overflow {
+				// The sender emits one marker per step it couldn't buffer
+				sr.lostSteps++
+				sr.positionLost = true
+				sr.stats.overflowMarkers.Add(1)
+				log.Println("Buffer overflow detected!")
+				sr.statusChan <- StatusMessage{
+					Device: DeviceTypeSerial,
+					Status: StatusOverflow,
+					Error:  "Buffer overflow detected",
+				}
+				continue
+			}
 
-		// Update count based on direction
-		if direction == 1 {
-			sr.count++
-		} else {
-			sr.count--
+			reading := sr.processFrame(frame, currentTime)
+			select {
+			case readings <- reading:
+			default:
+				// The consumer isn't keeping up
+				sr.stats.backpressureStalls.Add(1)
+				readings <- reading
+			}
 		}
+		sr.stats.checksumFailures.Add(sr.decoder.ChecksumFailures() - checksumFailures)
+	}
+}
 
-		reading := Reading{
-			TotalMicros: uint64(totalMicros),
-			Count:       sr.count,
-			TimestampDrift:  currentTime - int64(totalMicros),
+// checkSequence counts the steps lost since the previous v2 frame. It
+// returns false for a frame from before the previous one, which a datagram
+// transport can deliver late or twice, and whose step has either been
+// counted already or is among those already given up as lost.
+func (sr *SerialReader) checkSequence(sequence uint16) bool {
+	if sr.haveSequence {
+		gap := sequence - sr.lastSequence - 1
+		if gap > math.MaxUint16/2 {
+			return false
+		}
+		if gap != 0 {
+			sr.lostSteps += uint64(gap)
+			sr.positionLost = true
+			log.Printf("Sequence gap: %d steps lost (%d total)", gap, sr.lostSteps)
+			sr.statusChan <- StatusMessage{
+				Device: DeviceTypeSerial,
+				Status: StatusSequenceGap,
+				Error:  fmt.Sprintf("%d steps lost (%d total)", gap, sr.lostSteps),
+			}
 		}
-
-		readings <- reading
 	}
+	sr.lastSequence = sequence
+	sr.haveSequence = true
+	return true
 }
 
-func (sr *SerialReader) readAndValidatePacket() (uint32, uint8, int64, bool) {
-	// Read exactly 5 bytes
-	n, err := io.ReadFull(sr.port, sr.buffer)
-	currentTime := time.Now().UnixMicro()
-	if err != nil || n != 5 {
+// readChunk reads whatever bytes are available into the frame decoder and
+// returns the host time at which they arrived.
+func (sr *SerialReader) readChunk() (int64, error) {
+	n, err := sr.port.Read(sr.buffer)
+	currentTime := sr.now()
+	if sr.stopping.Load() {
+		return currentTime, errReaderClosed
+	}
+	if err == nil && n == 0 {
+		// A blocking read with no data means the device has gone away
+		err = io.EOF
+	}
+	if err == io.EOF {
+		return currentTime, err
+	}
+	if err != nil {
 		log.Printf("Error reading from serial: %v", err)
 		sr.consecutiveErrors++
 		sr.statusChan <- StatusMessage{
@@ -152,53 +269,80 @@ func (sr *SerialReader) readAndValidatePacket() (uint32, uint8, int64, bool) {
 			Status: StatusError,
 			Error:  err.Error(),
 		}
-		return 0, 0, currentTime, false
+		return currentTime, err
 	}
 	sr.consecutiveErrors = 0
 
-	if sr.isOverflow() {
-		log.Println("Buffer overflow detected!")
+	sr.stats.bytes.Add(uint64(n))
+	sr.decoder.Write(sr.buffer[:n])
+	return currentTime, nil
+}
+
+// processFrame converts a decoded frame into a Reading on the host timebase.
+func (sr *SerialReader) processFrame(frame Frame, currentTime int64) Reading {
+	timestamp := frame.Timestamp
+
+	// Initialize time offset on first reading
+	if sr.timeOffset == 0 {
+		sr.timeOffset = currentTime
+		sr.firstTimestamp = uint64(timestamp)
+	} else {
+		// Check if more than 60 seconds have elapsed since last reading
+		if currentTime-sr.lastReadingTime > 60*1000000 {
+			// Resync the time offset
+			sr.timeOffset = currentTime
+			sr.firstTimestamp = uint64(timestamp)
+			sr.overflowCount = 0 // Reset overflow count with new sync
+			sr.skew.Reset()      // The device may have restarted
+			sr.haveSequence = false
+			log.Printf("Resyncing time offset due to >60s gap between readings")
+		}
+	}
+	sr.lastReadingTime = currentTime
+
+	// Handle timestamp overflow
+	if timestamp < sr.lastTimestamp {
+		sr.overflowCount++
+		sr.stats.timestampWraps.Add(1)
+		log.Printf("Timestamp overflow detected! Count: %d", sr.overflowCount)
 		sr.statusChan <- StatusMessage{
 			Device: DeviceTypeSerial,
 			Status: StatusOverflow,
-			Error:  "Buffer overflow detected",
+			Error:  fmt.Sprintf("Overflow count: %d", sr.overflowCount),
 		}
-		return 0, 0, currentTime, false
 	}
+	sr.lastTimestamp = timestamp
 
-	if !sr.validateChecksum() {
-		return 0, 0, currentTime, false
-	}
+	// Calculate device microseconds since first reading
+	deviceMicros := uint64(timestamp) + (sr.overflowCount << 32) - sr.firstTimestamp
 
-	timestamp := binary.BigEndian.Uint32(sr.buffer[:4])
-	direction := (sr.buffer[4] >> 7) & 1
+	// Calculate actual Unix epoch microseconds
+	totalMicros := sr.timeOffset + int64(deviceMicros)
 
-	return timestamp, direction, currentTime, true
-}
-
-func (sr *SerialReader) isOverflow() bool {
-	for i := 0; i < 5; i++ {
-		if sr.buffer[i] != 0xFF {
-			return false
-		}
+	sr.skew.Add(int64(deviceMicros), currentTime)
+	estimate := sr.skew.Estimate()
+	clockOffset := currentTime - totalMicros
+	if hostTime, ok := sr.skew.HostTime(int64(deviceMicros)); ok {
+		clockOffset = hostTime - totalMicros
 	}
-	return true
-}
 
-func (sr *SerialReader) validateChecksum() bool {
-	calculatedChecksum := uint8(0)
-	for i := 0; i < 4; i++ {
-		calculatedChecksum ^= sr.buffer[i]
+	// Update count based on direction
+	if frame.Direction == 1 {
+		sr.count++
+	} else {
+		sr.count--
 	}
-	calculatedChecksum &= 0x7F
 
-	receivedChecksum := sr.buffer[4] & 0x7F
+	reading := Reading{
+		TotalMicros:    uint64(totalMicros),
+		Count:          sr.count,
+		TimestampDrift: currentTime - int64(totalMicros),
+		ClockOffset:    clockOffset,
+		SkewPPM:        estimate.SkewPPM,
+		LostSteps:      sr.lostSteps,
 
-	if calculatedChecksum != receivedChecksum {
-		log.Printf("Checksum mismatch! Bytes: %02x %02x %02x %02x, Final: %02x",
-			sr.buffer[0], sr.buffer[1], sr.buffer[2], sr.buffer[3], sr.buffer[4])
-		log.Printf("Calculated: %02x, Received: %02x", calculatedChecksum, receivedChecksum)
-		return false
+		PositionUncertain: sr.positionLost,
 	}
-	return true
+	sr.positionLost = false
+	return reading
 }
@@ -1,30 +1,39 @@
 package receiver
 
 import (
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"go.bug.st/serial"
 )
 
 type Server struct {
+	config     Config
 	wsServer   *WebSocketServer
 	readings   chan Reading
 	statusChan chan StatusMessage
-	serialPort serial.Port
-	serialMux  sync.Mutex
-	tareOffset int
+	db         *sql.DB
+	writer     *dbWriter
+	stop       chan struct{} // Closed to stop broadcastMessages
+	stopped    chan struct{} // Closed once broadcastMessages has returned
+	clocks     map[string]*Clock
+	clocksMux  sync.Mutex
 	bmp180        *BMP180
 	bmp180Readings chan BMP180Reading
 	bmp390        *BMP390
 	bmp390Readings chan BMP390Reading
 	sht           *SHT85
 	shtReadings   chan SHT85Reading
-	dataRecorder  *DataRecorder
 }
 
 type BMP180Reading struct {
@@ -48,19 +57,50 @@ type SHT85Reading struct {
 	Timestamp   int64   `json:"timestamp"`
 }
 
-func NewServer() *Server {
+// CycleMessage announces a newly recorded cycle to WebSocket clients.
+type CycleMessage struct {
+	Type    string `json:"type"`
+	ClockID string `json:"clock_id"`
+	HistoricalData
+}
+
+// KinematicsMessage carries the smoothed velocity and acceleration at one
+// encoder edge to WebSocket clients.
+type KinematicsMessage struct {
+	Type    string `json:"type"`
+	ClockID string `json:"clock_id"`
+	Kinematics
+}
+
+func NewServer(config Config) *Server {
 	s := &Server{
-		readings:     make(chan Reading),
+		config:       config,
+		readings:     make(chan Reading, 1024), // Absorbs bursts; a full buffer counts as a stall
 		statusChan:   make(chan StatusMessage),
 		bmp180Readings:  make(chan BMP180Reading),
 		bmp390Readings:  make(chan BMP390Reading),
 		shtReadings:  make(chan SHT85Reading),
+		clocks:       make(map[string]*Clock),
+		stop:         make(chan struct{}),
 	}
-	dr, err := NewDataRecorder()
+	db, err := OpenDatabase(config.DBPath)
 	if err != nil {
-		log.Printf("Failed to initialize DataRecorder: %v", err)
+		log.Printf("Failed to open database: %v", err)
 	} else {
-		s.dataRecorder = dr
+		s.db = db
+		s.writer = newDBWriter(db)
+	}
+
+	// Make clocks with existing records available before they reconnect
+	s.Clock(DefaultClockID)
+	if s.db != nil {
+		ids, err := ClockIDs(s.db)
+		if err != nil {
+			log.Printf("Failed to list clocks: %v", err)
+		}
+		for _, id := range ids {
+			s.Clock(id)
+		}
 	}
 
 	ws := NewWebSocketServer()
@@ -98,8 +138,23 @@ func (s *Server) Start() {
 	http.HandleFunc("/connect", s.handleConnectSerialPort)
 	http.HandleFunc("/tare", s.handleTare)
 	http.HandleFunc("/historical_data", s.handleHistoricalData)
-
+	http.HandleFunc("/summary", s.handleSummary)
+	http.HandleFunc("/simulator", s.handleSimulator)
+	http.HandleFunc("/clock_skew", s.handleClockSkew)
+	http.HandleFunc("/stats", s.handleStats)
+	http.HandleFunc("/clocks", s.handleClocks)
+	http.HandleFunc("/clock_config", s.handleClockConfig)
+	http.HandleFunc("/dial", s.handleDial)
+	http.HandleFunc("/trace", s.handleTrace)
+	http.HandleFunc("/rollups", s.handleRollups)
+	http.HandleFunc("/storage", s.handleStorage)
+
+	s.stopped = make(chan struct{})
 	go s.broadcastMessages()
+	go s.monitorLinkStats()
+	if s.db != nil {
+		go s.pruneDatabase()
+	}
 
 	// Start BMP180 monitoring if available
 	if s.bmp180 != nil {
@@ -116,39 +171,251 @@ func (s *Server) Start() {
 		go s.monitorSHT85()
 	}
 
-	// Block main goroutine
-	select {}
+	// Run until interrupted, then write out everything still queued
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %v, shutting down", sig)
+	s.Close()
+}
+
+// Close stops reading from the encoders, writes out the clocks' records
+// and closes the database.
+func (s *Server) Close() {
+	if s.db == nil {
+		return
+	}
+
+	// Let broadcastMessages record whatever the readers left queued before
+	// the writer stops taking records. Once every clock has passed on its
+	// queue, nothing more can arrive on s.readings.
+	for _, clock := range s.allClocks() {
+		clock.disconnect()
+	}
+	if s.stopped != nil {
+		for _, clock := range s.allClocks() {
+			clock.flush()
+		}
+		close(s.stop)
+		<-s.stopped
+	}
+
+	s.writer.Close()
+	for _, clock := range s.allClocks() {
+		if clock.dataRecorder != nil {
+			if err := clock.dataRecorder.Close(); err != nil {
+				log.Printf("Clock %s: failed to close recorder: %v", clock.ID, err)
+			}
+		}
+	}
+	if stats := s.writer.Stats(); stats.Dropped > 0 {
+		log.Printf("%d database writes were dropped", stats.Dropped)
+	}
+	if err := s.db.Close(); err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
 }
 
 func (s *Server) broadcastMessages() {
+	defer close(s.stopped)
 	for {
 		select {
 		case reading := <-s.readings:
-			if s.dataRecorder != nil {
-				s.dataRecorder.AddReading(reading, int(s.tareOffset))
+			s.handleReading(reading)
+		case <-s.stop:
+			for {
+				select {
+				case reading := <-s.readings:
+					s.handleReading(reading)
+				default:
+					return
+				}
 			}
-			s.wsServer.Broadcast(reading)
 		case status := <-s.statusChan:
 			s.wsServer.Broadcast(status)
 		case bmp180Reading := <-s.bmp180Readings:
-			if s.dataRecorder != nil {
-				s.dataRecorder.UpdateBMP180(bmp180Reading)
+			// The sensors are shared by every clock in the room
+			for _, clock := range s.allClocks() {
+				if clock.dataRecorder != nil {
+					clock.dataRecorder.UpdateBMP180(bmp180Reading)
+				}
 			}
 			s.wsServer.Broadcast(bmp180Reading)
 		case bmp390Reading := <-s.bmp390Readings:
-			if s.dataRecorder != nil {
-				s.dataRecorder.UpdateBMP390(bmp390Reading)
+			// The sensors are shared by every clock in the room
+			for _, clock := range s.allClocks() {
+				if clock.dataRecorder != nil {
+					clock.dataRecorder.UpdateBMP390(bmp390Reading)
+				}
 			}
 			s.wsServer.Broadcast(bmp390Reading)
 		case shtReading := <-s.shtReadings:
-			if s.dataRecorder != nil {
-				s.dataRecorder.UpdateSHT85(shtReading)
+			// The sensors are shared by every clock in the room
+			for _, clock := range s.allClocks() {
+				if clock.dataRecorder != nil {
+					clock.dataRecorder.UpdateSHT85(shtReading)
+				}
 			}
 			s.wsServer.Broadcast(shtReading)
 		}
 	}
 }
 
+// handleReading records an encoder reading and passes it on to WebSocket
+// clients, along with anything it completed.
+func (s *Server) handleReading(reading Reading) {
+	var kinematics *Kinematics
+	var cycle *HistoricalData
+	if clock := s.findClock(reading.ClockID); clock != nil && clock.dataRecorder != nil {
+		reading, kinematics, cycle = clock.dataRecorder.AddReading(reading, clock.TareOffset())
+	}
+	s.wsServer.Broadcast(reading)
+	if kinematics != nil {
+		s.wsServer.Broadcast(KinematicsMessage{
+			Type:       "KINEMATICS",
+			ClockID:    reading.ClockID,
+			Kinematics: *kinematics,
+		})
+	}
+	if cycle != nil {
+		s.wsServer.Broadcast(CycleMessage{
+			Type:           "CYCLE",
+			ClockID:        reading.ClockID,
+			HistoricalData: *cycle,
+		})
+	}
+}
+
+// Clock returns the clock with the given ID, creating it if necessary.
+func (s *Server) Clock(id string) *Clock {
+	s.clocksMux.Lock()
+	defer s.clocksMux.Unlock()
+
+	clock, ok := s.clocks[id]
+	if !ok {
+		clock = newClock(id, s)
+		s.clocks[id] = clock
+	}
+	return clock
+}
+
+// findClock returns the clock with the given ID, or nil if there isn't one.
+func (s *Server) findClock(id string) *Clock {
+	s.clocksMux.Lock()
+	defer s.clocksMux.Unlock()
+	return s.clocks[id]
+}
+
+// allClocks returns every clock, ordered by ID.
+func (s *Server) allClocks() []*Clock {
+	s.clocksMux.Lock()
+	defer s.clocksMux.Unlock()
+
+	clocks := make([]*Clock, 0, len(s.clocks))
+	for _, clock := range s.clocks {
+		clocks = append(clocks, clock)
+	}
+	sort.Slice(clocks, func(i, j int) bool { return clocks[i].ID < clocks[j].ID })
+	return clocks
+}
+
+// requestClock returns the clock named by the request's "clock" query
+// parameter, or the default clock if there isn't one. With create set a
+// new clock is made for an unknown ID; otherwise the request fails.
+func (s *Server) requestClock(w http.ResponseWriter, r *http.Request, create bool) *Clock {
+	id := r.URL.Query().Get("clock")
+	if id == "" {
+		id = DefaultClockID
+	}
+	if !clockIDPattern.MatchString(id) {
+		http.Error(w, "Invalid clock ID", http.StatusBadRequest)
+		return nil
+	}
+
+	if create {
+		return s.Clock(id)
+	}
+	clock := s.findClock(id)
+	if clock == nil {
+		http.Error(w, "Unknown clock", http.StatusNotFound)
+	}
+	return clock
+}
+
+func (s *Server) handleClocks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var clocks []ClockInfo
+	for _, clock := range s.allClocks() {
+		clocks = append(clocks, clock.Info())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clocks)
+}
+
+// clockConfigResponse adds derived values to ClockConfig for display.
+type clockConfigResponse struct {
+	ClockConfig
+	DegreesPerCount float64 `json:"degrees_per_count"`
+}
+
+func (s *Server) handleClockConfig(w http.ResponseWriter, r *http.Request) {
+	clock := s.requestClock(w, r, r.Method == http.MethodPost)
+	if clock == nil {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost:
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		config := clock.Config()
+		var period struct {
+			NominalPeriod *float64 `json:"nominal_period"`
+			BPH           *float64 `json:"bph"`
+		}
+		if json.Unmarshal(body, &config) != nil || json.Unmarshal(body, &period) != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		// The period can be given either way, and giving one replaces the other
+		if period.NominalPeriod == nil && period.BPH != nil {
+			config.NominalPeriod = 0
+		}
+		if period.BPH == nil && period.NominalPeriod != nil {
+			config.BPH = 0
+		}
+		if err := config.Validate(); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid config: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := clock.SetConfig(config); err != nil {
+			http.Error(w, "Failed to save config", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config := clock.Config()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clockConfigResponse{
+		ClockConfig:     config,
+		DegreesPerCount: config.Geometry.DegreesPerCount(),
+	})
+}
+
 func (s *Server) handleListSerialPorts(w http.ResponseWriter, r *http.Request) {
 	ports, err := serial.GetPortsList()
 	if err != nil {
@@ -165,63 +432,165 @@ func (s *Server) handleConnectSerialPort(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	var req struct {
-		PortName string `json:"port_name"`
-		BaudRate int    `json:"baud_rate"`
+	clock := s.requestClock(w, r, true)
+	if clock == nil {
+		return
 	}
 
+	var req TransportConfig
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	s.serialMux.Lock()
-	defer s.serialMux.Unlock()
+	if err := clock.Connect(req); err != nil {
+		http.Error(w, "Failed to open encoder transport", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleSimulator(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clock := s.requestClock(w, r, false)
+	if clock == nil {
+		return
+	}
 
-	// Close existing port if connected
-	if s.serialPort != nil {
-		s.serialPort.Close()
-		s.serialPort = nil
+	sim := clock.currentSimulator()
+	if sim == nil {
+		http.Error(w, "Simulator not running", http.StatusNotFound)
+		return
 	}
 
-	mode := &serial.Mode{BaudRate: req.BaudRate}
-	port, err := serial.Open(req.PortName, mode)
-	if err != nil {
-		log.Printf("Failed to open serial port %s: %v", req.PortName, err)
-		s.statusChan <- StatusMessage{Status: "Serial Error", Error: err.Error()}
-		http.Error(w, "Failed to open serial port", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sim.Truth())
+}
+
+func (s *Server) handleClockSkew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	s.serialPort = port
-	serialReader := NewSerialReader(port, s.statusChan)
-	go serialReader.StartReading(s.readings)
+	clock := s.requestClock(w, r, false)
+	if clock == nil {
+		return
+	}
 
-	log.Printf("Connected to %s with baud rate %d", req.PortName, req.BaudRate)
-	w.WriteHeader(http.StatusOK)
+	reader := clock.currentReader()
+	var estimate ClockSkew
+	if reader != nil {
+		estimate = reader.ClockSkew()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(estimate)
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clock := s.requestClock(w, r, false)
+	if clock == nil {
+		return
+	}
+
+	stats := clock.linkStats.Snapshot()
+	stats.ClockID = clock.ID
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// handleDial reports the clock's virtual dial, or on POST records that the
+// clock's hands were set to the correct time. The body's time is in Unix
+// micros and defaults to now.
+func (s *Server) handleDial(w http.ResponseWriter, r *http.Request) {
+	clock := s.requestClock(w, r, false)
+	if clock == nil {
+		return
+	}
+	if clock.dataRecorder == nil {
+		http.Error(w, "Data recorder not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost:
+		var req struct {
+			Time int64 `json:"time"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Time == 0 {
+			req.Time = time.Now().UnixMicro()
+		}
+		if err := clock.dataRecorder.SyncDial(req.Time); err != nil {
+			log.Printf("Clock %s: failed to save dial: %v", clock.ID, err)
+			http.Error(w, "Failed to save dial", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clock.dataRecorder.Dial())
 }
 
-func (s *Server) getCurrentSerialStatus() StatusMessage {
-	s.serialMux.Lock()
-	defer s.serialMux.Unlock()
+// monitorLinkStats updates the frame rate and pushes the link statistics
+// to WebSocket clients.
+func (s *Server) monitorLinkStats() {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
 
-	if s.serialPort == nil {
-		return StatusMessage{
-			Device: DeviceTypeSerial,
-			Status: StatusDisconnected,
+	for range ticker.C {
+		for _, clock := range s.allClocks() {
+			clock.linkStats.Tick()
+			stats := clock.linkStats.Snapshot()
+			stats.ClockID = clock.ID
+			s.wsServer.Broadcast(stats)
 		}
 	}
-	return StatusMessage{
-		Device: DeviceTypeSerial,
-		Status: StatusConnected,
+}
+
+// getCurrentSerialStatus returns every clock's connection status, for
+// newly connected WebSocket clients.
+func (s *Server) getCurrentSerialStatus() []StatusMessage {
+	var statuses []StatusMessage
+	for _, clock := range s.allClocks() {
+		statuses = append(statuses, clock.currentSerialStatus())
 	}
+	return statuses
 }
 
 func (s *Server) handleTare(w http.ResponseWriter, r *http.Request) {
+	clock := s.requestClock(w, r, r.Method == http.MethodPost)
+	if clock == nil {
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
 		json.NewEncoder(w).Encode(map[string]int{
-			"value": s.tareOffset,
+			"value": clock.TareOffset(),
 		})
 
 	case http.MethodPost:
@@ -232,7 +601,7 @@ func (s *Server) handleTare(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
-		s.tareOffset = req.Value
+		clock.SetTareOffset(req.Value)
 		w.WriteHeader(http.StatusOK)
 
 	default:
@@ -325,12 +694,53 @@ func (s *Server) handleHistoricalData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if s.dataRecorder == nil {
+	clock := s.requestClock(w, r, false)
+	if clock == nil {
+		return
+	}
+	if clock.dataRecorder == nil {
 		http.Error(w, "Data recorder not initialized", http.StatusInternalServerError)
 		return
 	}
 
-	data, err := s.dataRecorder.GetHistoricalData(startTime, endTime)
+	// Long ranges can be aggregated into buckets, given either the width
+	// of each in micros or roughly how many are wanted
+	var width int64
+	if param := r.URL.Query().Get("bucket"); param != "" {
+		width, err = strconv.ParseInt(param, 10, 64)
+		if err != nil || width <= 0 {
+			http.Error(w, "Invalid bucket width", http.StatusBadRequest)
+			return
+		}
+	} else if param := r.URL.Query().Get("points"); param != "" {
+		points, err := strconv.Atoi(param)
+		if err != nil || points <= 0 {
+			http.Error(w, "Invalid point count", http.StatusBadRequest)
+			return
+		}
+		width, err = BucketWidth(startTime, endTime, points)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid time range: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if width > 0 {
+		if bucketCount(startTime, endTime, width) > maxBuckets {
+			http.Error(w, fmt.Sprintf("Too many buckets, the limit is %d", maxBuckets), http.StatusBadRequest)
+			return
+		}
+		buckets, err := clock.dataRecorder.GetHistoricalBuckets(startTime, endTime, width)
+		if err != nil {
+			log.Printf("Clock %s: bucketed query failed: %v", clock.ID, err)
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(buckets)
+		return
+	}
+
+	data, err := clock.dataRecorder.GetHistoricalData(startTime, endTime)
 	if err != nil {
 		http.Error(w, "Database query failed", http.StatusInternalServerError)
 		return
@@ -338,4 +748,200 @@ func (s *Server) handleHistoricalData(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(data)
-}
\ No newline at end of file
+}
+
+func (s *Server) handleSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	startTime, err := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid start time", http.StatusBadRequest)
+		return
+	}
+
+	endTime, err := strconv.ParseInt(r.URL.Query().Get("end"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid end time", http.StatusBadRequest)
+		return
+	}
+
+	clock := s.requestClock(w, r, false)
+	if clock == nil {
+		return
+	}
+	if clock.dataRecorder == nil {
+		http.Error(w, "Data recorder not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	summary, err := clock.dataRecorder.GetSummary(startTime, endTime)
+	if err != nil {
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+type traceResponse struct {
+	Points    []TracePoint `json:"points"`
+	Truncated bool         `json:"truncated"` // More events were in range than were returned
+}
+
+// handleTrace returns the raw step events between start and end, in device
+// micros.
+func (s *Server) handleTrace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	startTime, err := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid start time", http.StatusBadRequest)
+		return
+	}
+
+	endTime, err := strconv.ParseInt(r.URL.Query().Get("end"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid end time", http.StatusBadRequest)
+		return
+	}
+
+	clock := s.requestClock(w, r, false)
+	if clock == nil {
+		return
+	}
+	if clock.dataRecorder == nil {
+		http.Error(w, "Data recorder not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	points, truncated, err := clock.dataRecorder.GetTrace(startTime, endTime)
+	if err != nil {
+		log.Printf("Clock %s: trace query failed: %v", clock.ID, err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(traceResponse{Points: points, Truncated: truncated})
+}
+
+// handleRollups returns a clock's rollups at one resolution on GET, and
+// rebuilds them from its cycle records on POST. start and end are optional
+// for a rebuild, which defaults to every record still kept.
+func (s *Server) handleRollups(w http.ResponseWriter, r *http.Request) {
+	clock := s.requestClock(w, r, false)
+	if clock == nil {
+		return
+	}
+	if clock.dataRecorder == nil {
+		http.Error(w, "Data recorder not initialized", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		resolution, ok := FindRollupResolution(query.Get("resolution"))
+		if !ok {
+			http.Error(w, "Invalid resolution, expected 1m, 1h or 1d", http.StatusBadRequest)
+			return
+		}
+		startTime, err := strconv.ParseInt(query.Get("start"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid start time", http.StatusBadRequest)
+			return
+		}
+		endTime, err := strconv.ParseInt(query.Get("end"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid end time", http.StatusBadRequest)
+			return
+		}
+
+		rollups, err := clock.dataRecorder.GetRollups(resolution, startTime, endTime)
+		if err != nil {
+			log.Printf("Clock %s: rollup query failed: %v", clock.ID, err)
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rollups)
+
+	case http.MethodPost:
+		startTime, endTime, ok, err := clock.dataRecorder.ReadingsSpan()
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			return
+		}
+		if param := query.Get("start"); param != "" {
+			if startTime, err = strconv.ParseInt(param, 10, 64); err != nil {
+				http.Error(w, "Invalid start time", http.StatusBadRequest)
+				return
+			}
+			ok = true
+		}
+		if param := query.Get("end"); param != "" {
+			if endTime, err = strconv.ParseInt(param, 10, 64); err != nil {
+				http.Error(w, "Invalid end time", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if ok {
+			if err := clock.dataRecorder.RebuildRollups(startTime, endTime); err != nil {
+				log.Printf("Clock %s: rollup rebuild failed: %v", clock.ID, err)
+				http.Error(w, "Failed to rebuild rollups", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{"start": startTime, "end": endTime})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// pruneDatabase applies the retention policy at startup and then
+// periodically.
+func (s *Server) pruneDatabase() {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := pruneDatabase(s.db, s.config, time.Now()); err != nil {
+			log.Printf("Failed to prune database: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// handleStorage reports the database's size and how far back each table
+// goes.
+func (s *Server) handleStorage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.db == nil {
+		http.Error(w, "Database not open", http.StatusInternalServerError)
+		return
+	}
+
+	stats, err := GetStorageStats(s.db, s.config)
+	if err != nil {
+		log.Printf("Failed to get storage stats: %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	stats.Writer = s.writer.Stats()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
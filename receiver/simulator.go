@@ -0,0 +1,456 @@
+package receiver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+const TransportSimulator = "simulator"
+
+// simStep is the simulator's integration step in microseconds.
+const simStep = 10
+
+// SimulatorConfig describes the simulated balance wheel and encoder link.
+type SimulatorConfig struct {
+	Period         float64 `json:"period"`           // Seconds per full oscillation
+	Amplitude      float64 `json:"amplitude"`        // Peak-to-peak swing in degrees
+	Q              float64 `json:"q"`                // Damping, as the oscillator's quality factor
+	Impulse        float64 `json:"impulse"`          // Degrees added to each swing by the escapement; 0 holds Amplitude steady
+	ImpulseNoise   float64 `json:"impulse_noise"`    // Standard deviation of each impulse, as a fraction of it
+	LiftAngle      float64 `json:"lift_angle"`       // Degrees either side of equilibrium over which the impulse acts; 0 for an instant kick
+	DegreesPerStep float64 `json:"degrees_per_step"` // Encoder resolution
+	BeatError      float64 `json:"beat_error"`       // Milliseconds; positive lengthens the positive-going half period
+	Jitter         float64 `json:"jitter"`           // Standard deviation of timestamp noise in microseconds
+	DropRate       float64 `json:"drop_rate"`        // Fraction of frames silently lost
+	OverflowRate   float64 `json:"overflow_rate"`    // Fraction of frames replaced by an overflow marker
+	StartMicros    uint32  `json:"start_micros"`     // Initial device timestamp, to exercise wraparound
+	Protocol       int     `json:"protocol"`         // Frame protocol version, 1 or 2
+	Duration       float64 `json:"duration"`         // Seconds to run for; 0 runs forever
+	Realtime       bool    `json:"realtime"`         // Pace output to the wall clock
+	Seed           int64   `json:"seed"`
+}
+
+func DefaultSimulatorConfig() SimulatorConfig {
+	return SimulatorConfig{
+		Period:         1.0,
+		Amplitude:      240,
+		Q:              150,
+		DegreesPerStep: 2,
+		Jitter:         5,
+		Protocol:       1,
+		Realtime:       true,
+		Seed:           1,
+	}
+}
+
+// UnmarshalJSON decodes data over the defaults, so a request need only
+// give the settings it changes.
+func (sc *SimulatorConfig) UnmarshalJSON(data []byte) error {
+	type plain SimulatorConfig // Without this method, to avoid recursion
+	config := plain(DefaultSimulatorConfig())
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	*sc = SimulatorConfig(config)
+	return nil
+}
+
+// SimulatorTruth is the simulator's ground truth, for checking the analysis.
+type SimulatorTruth struct {
+	Period    float64 `json:"period"`    // Seconds, of the last full swing
+	Amplitude float64 `json:"amplitude"` // Peak-to-peak degrees of the last full swing
+	BeatError float64 `json:"beat_error"`
+	// The latest impulse, as degrees added to the swing's amplitude, and
+	// how long it lasted in milliseconds, centred on the zero crossing
+	Impulse         float64 `json:"impulse"`
+	ImpulseDuration float64 `json:"impulse_duration"`
+	// The encoder count at the start, relative to the encoder's zero. A
+	// reader counts from wherever the wheel starts, so adding this to its
+	// counts recovers the true position.
+	StartCount int    `json:"start_count"`
+	Steps      uint64 `json:"steps"`
+	Dropped    uint64 `json:"dropped"`
+	Overflows  uint64 `json:"overflows"`
+}
+
+// SimulatorCycle is the ground truth for one full swing, for comparing
+// with the analysis cycle by cycle.
+type SimulatorCycle struct {
+	Time      int64 // Host micros of the zero crossing ending the swing
+	Period    float64
+	Amplitude float64
+	BeatError float64
+	Impulse   float64
+}
+
+// Simulator is a Transport producing the frame stream the ESP8266 would
+// send for a damped balance wheel kept going by an escapement.
+//
+// The wheel is a damped harmonic oscillator about an equilibrium that is
+// offset from the encoder's zero to produce beat error. Within the lift
+// angle either side of equilibrium the escapement pushes it along with a
+// constant force, sized so that each impulse adds a fixed amount to the
+// amplitude. A constant force on a harmonic oscillator just moves its
+// centre, so the motion is a sequence of damped sinusoids, each starting
+// from where the last one left off.
+type Simulator struct {
+	config   SimulatorConfig
+	rng      *rand.Rand
+	hostBase int64
+	started  time.Time
+
+	micros  int64   // Simulated time since start
+	omega   float64 // Angular frequency, per micro
+	damping float64 // Decay rate of the amplitude, per micro
+	impulse float64 // Degrees of amplitude added by each impulse
+	offset  float64 // Equilibrium position relative to encoder zero
+
+	// The current segment of motion
+	segStart  int64
+	segCentre float64
+	segAmp    float64
+	segPhase  float64
+
+	lifting      bool    // Within the lift angle
+	liftStart    int64   // When the current impulse began
+	liftGain     float64 // Amplitude the current impulse will add
+	lastPos      float64
+	lastVel      float64
+	positivePeak float64
+	negativePeak float64
+	lastCrossing float64 // Time the wheel last passed the encoder's zero
+	positiveLobe float64 // Time spent on each side of the encoder's zero
+	negativeLobe float64
+
+	count     int
+	sequence  uint16
+	lastStamp int64
+	pending   []byte
+
+	mu          sync.Mutex
+	truth       SimulatorTruth
+	trackCycles bool
+	cycles      []SimulatorCycle
+	closed      chan struct{}
+	once        sync.Once
+}
+
+func NewSimulator(config SimulatorConfig) *Simulator {
+	if config.Period <= 0 {
+		config.Period = 1.0
+	}
+	if config.DegreesPerStep <= 0 {
+		config.DegreesPerStep = 2
+	}
+
+	halfAmp := config.Amplitude / 2
+	decay := 1.0
+	damping := 0.0
+	if config.Q > 0 {
+		decay = math.Exp(-math.Pi / (2 * config.Q))
+		damping = math.Pi / (config.Period * 1e6 * config.Q)
+	}
+	impulse := config.Impulse / 2
+	if config.Impulse == 0 {
+		// The impulse comes a quarter cycle after the peak, by when the
+		// amplitude has decayed by √decay
+		impulse = halfAmp * (1 - decay) / math.Sqrt(decay)
+	}
+	offset := -halfAmp * math.Sin(math.Pi*config.BeatError/1000/config.Period)
+
+	// Start at the positive turning point, about to swing back
+	sim := &Simulator{
+		config:       config,
+		rng:          rand.New(rand.NewSource(config.Seed)),
+		hostBase:     time.Now().UnixMicro(),
+		started:      time.Now(),
+		omega:        2 * math.Pi / (config.Period * 1e6),
+		damping:      damping,
+		impulse:      impulse,
+		offset:       offset,
+		segCentre:    offset,
+		segAmp:       halfAmp,
+		segPhase:     math.Pi / 2,
+		lastPos:      offset + halfAmp,
+		lastVel:      -1,
+		positivePeak: offset + halfAmp,
+		negativePeak: offset - halfAmp,
+		closed:       make(chan struct{}),
+	}
+	sim.count = sim.encoderCount(offset + halfAmp)
+	sim.truth = SimulatorTruth{
+		Period:     config.Period,
+		Amplitude:  config.Amplitude,
+		BeatError:  config.BeatError,
+		StartCount: sim.count,
+	}
+	return sim
+}
+
+func (sim *Simulator) Read(p []byte) (int, error) {
+	for len(sim.pending) == 0 {
+		select {
+		case <-sim.closed:
+			return 0, errors.New("simulator closed")
+		default:
+		}
+
+		if sim.config.Duration > 0 && float64(sim.micros) >= sim.config.Duration*1e6 {
+			return 0, io.EOF
+		}
+
+		// Produce 10ms of output at a time
+		sim.run(10000)
+
+		if sim.config.Realtime {
+			wait := time.Duration(sim.micros)*time.Microsecond - time.Since(sim.started)
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-sim.closed:
+					return 0, errors.New("simulator closed")
+				}
+			}
+		}
+	}
+
+	n := copy(p, sim.pending)
+	sim.pending = sim.pending[n:]
+	return n, nil
+}
+
+// run advances the simulation by the given number of microseconds.
+func (sim *Simulator) run(micros int64) {
+	end := sim.micros + micros
+
+	for sim.micros < end {
+		sim.micros += simStep
+		pos, vel := sim.state()
+		sim.escapement(pos, vel)
+
+		// Turning points, for the true amplitude
+		if (vel < 0) != (sim.lastVel < 0) {
+			if sim.lastVel > 0 {
+				sim.positivePeak = pos
+			} else {
+				sim.negativePeak = pos
+			}
+			sim.mu.Lock()
+			sim.truth.Amplitude = sim.positivePeak - sim.negativePeak
+			sim.mu.Unlock()
+		}
+		// Zero crossings, for the true period and beat error
+		if (pos > 0) != (sim.lastPos > 0) {
+			crossing := float64(sim.micros) - simStep*pos/(pos-sim.lastPos)
+			if sim.lastCrossing > 0 {
+				if pos > 0 {
+					sim.negativeLobe = crossing - sim.lastCrossing
+				} else {
+					sim.positiveLobe = crossing - sim.lastCrossing
+				}
+			}
+			sim.lastCrossing = crossing
+			if sim.positiveLobe > 0 && sim.negativeLobe > 0 {
+				sim.mu.Lock()
+				sim.truth.Period = (sim.positiveLobe + sim.negativeLobe) / 1e6
+				sim.truth.BeatError = (sim.negativeLobe - sim.positiveLobe) / 2 / 1000
+				if sim.trackCycles {
+					sim.cycles = append(sim.cycles, SimulatorCycle{
+						Time:      sim.hostBase + int64(crossing),
+						Period:    sim.truth.Period,
+						Amplitude: sim.truth.Amplitude,
+						BeatError: sim.truth.BeatError,
+						Impulse:   sim.truth.Impulse,
+					})
+				}
+				sim.mu.Unlock()
+			}
+		}
+		sim.lastPos, sim.lastVel = pos, vel
+
+		target := sim.encoderCount(pos)
+		for sim.count != target {
+			var direction uint8
+			if target > sim.count {
+				sim.count++
+				direction = 1
+			} else {
+				sim.count--
+			}
+			sim.emit(direction)
+		}
+	}
+}
+
+// state returns the balance angle in degrees and its velocity in degrees
+// per micro at the current time.
+func (sim *Simulator) state() (float64, float64) {
+	t := float64(sim.micros - sim.segStart)
+	envelope := sim.segAmp * math.Exp(-sim.damping*t)
+	phase := sim.segPhase + sim.omega*t
+	pos := sim.segCentre + envelope*math.Sin(phase)
+	vel := envelope * (sim.omega*math.Cos(phase) - sim.damping*math.Sin(phase))
+	return pos, vel
+}
+
+// setCentre starts a new segment of motion about centre, continuing from
+// the given position and velocity.
+func (sim *Simulator) setCentre(centre, pos, vel float64) {
+	x := pos - centre
+	y := (vel + sim.damping*x) / sim.omega
+	sim.segStart = sim.micros
+	sim.segCentre = centre
+	sim.segAmp = math.Hypot(x, y)
+	sim.segPhase = math.Atan2(x, y)
+}
+
+// escapement applies the impulse as the wheel passes through the lift
+// angle, or all at once at equilibrium if the lift angle is 0.
+func (sim *Simulator) escapement(pos, vel float64) {
+	lift := sim.config.LiftAngle / 2
+	x := pos - sim.offset
+	prev := sim.lastPos - sim.offset
+
+	gain := func() float64 {
+		gain := sim.impulse
+		if sim.config.ImpulseNoise > 0 {
+			gain *= 1 + sim.config.ImpulseNoise*sim.rng.NormFloat64()
+		}
+		return gain
+	}
+	amplitude := func() float64 {
+		return math.Hypot(x, vel/sim.omega)
+	}
+
+	if lift <= 0 {
+		if (x > 0) != (prev > 0) {
+			sim.liftGain = gain()
+			a := amplitude()
+			sim.setCentre(sim.offset, pos, vel*(a+sim.liftGain)/a)
+			sim.recordImpulse(0)
+		}
+		return
+	}
+
+	inside := math.Abs(x) < lift
+	if inside == sim.lifting {
+		return
+	}
+	sim.lifting = inside
+	if !inside {
+		sim.setCentre(sim.offset, pos, vel)
+		sim.recordImpulse(float64(sim.micros-sim.liftStart) / 1000)
+		return
+	}
+
+	// A force f moves the centre by s = f/ω² and does work f over the lift
+	// angle, which must raise the energy ½ω²a² to match the gain
+	sim.liftStart = sim.micros
+	sim.liftGain = gain()
+	a := amplitude()
+	shift := ((a+sim.liftGain)*(a+sim.liftGain) - a*a) / (4 * lift)
+	if vel < 0 {
+		shift = -shift
+	}
+	sim.setCentre(sim.offset+shift, pos, vel)
+}
+
+func (sim *Simulator) recordImpulse(duration float64) {
+	sim.mu.Lock()
+	sim.truth.Impulse = sim.liftGain
+	sim.truth.ImpulseDuration = duration
+	sim.mu.Unlock()
+}
+
+func (sim *Simulator) encoderCount(degrees float64) int {
+	return int(math.Floor(degrees / sim.config.DegreesPerStep))
+}
+
+func (sim *Simulator) emit(direction uint8) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	sim.truth.Steps++
+
+	// Like the ESP8266, count every step even if it can't be sent
+	sequence := sim.sequence
+	sim.sequence++
+
+	r := sim.rng.Float64()
+	if r < sim.config.DropRate {
+		sim.truth.Dropped++
+		return
+	}
+	if r < sim.config.DropRate+sim.config.OverflowRate {
+		sim.truth.Overflows++
+		if sim.config.Protocol != 2 {
+			sim.pending = append(sim.pending, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+		}
+		return
+	}
+
+	stamp := sim.micros + int64(sim.rng.NormFloat64()*sim.config.Jitter)
+	if stamp < sim.lastStamp {
+		stamp = sim.lastStamp // The ESP8266 never sends timestamps out of order
+	}
+	sim.lastStamp = stamp
+
+	timestamp := sim.config.StartMicros + uint32(stamp)
+	if sim.config.Protocol == 2 {
+		var frame [frameSizeV2]byte
+		frame[0] = frameHeaderV2
+		binary.BigEndian.PutUint16(frame[1:3], sequence)
+		binary.BigEndian.PutUint32(frame[3:7], timestamp)
+		frame[7] = direction << 7
+		frame[8] = calculateCRC8(frame[:8])
+		sim.pending = append(sim.pending, frame[:]...)
+		return
+	}
+
+	var frame [frameSizeV1]byte
+	binary.BigEndian.PutUint32(frame[:4], timestamp)
+	checksum := (frame[0] ^ frame[1] ^ frame[2] ^ frame[3]) & 0x7F
+	frame[4] = direction<<7 | checksum
+	sim.pending = append(sim.pending, frame[:]...)
+}
+
+// Now returns the host time corresponding to the most recently simulated
+// instant, so that simulations run faster than real time still produce a
+// consistent timeline.
+func (sim *Simulator) Now() int64 {
+	return sim.hostBase + sim.micros
+}
+
+// Truth returns the simulator's current ground truth.
+func (sim *Simulator) Truth() SimulatorTruth {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return sim.truth
+}
+
+// TrackCycles keeps the ground truth for every swing from now on, for
+// Cycles to return. The history grows for as long as the simulation runs.
+func (sim *Simulator) TrackCycles() {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	sim.trackCycles = true
+}
+
+// Cycles returns the ground truth for each swing since TrackCycles, in
+// order, with a swing ending at every zero crossing.
+func (sim *Simulator) Cycles() []SimulatorCycle {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return slices.Clone(sim.cycles)
+}
+
+func (sim *Simulator) Close() error {
+	sim.once.Do(func() { close(sim.closed) })
+	return nil
+}
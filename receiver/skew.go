@@ -0,0 +1,228 @@
+package receiver
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	skewBinMicros       = 1000000 // One fit sample per second of device time
+	skewWindowBins      = 600     // Fit over the last ten minutes
+	skewMinBins         = 30
+	skewStepThreshold   = 20000 // Host clock jumps larger than this are steps, in micros
+	skewStepConfirmBins = 3
+)
+
+// ClockSkew is an estimate of how the host clock relates to the device
+// clock.
+type ClockSkew struct {
+	Valid     bool    `json:"valid"`
+	SkewPPM   float64 `json:"skew_ppm"` // Host micros per device micro, minus one, in ppm; positive when the device runs slow
+	Offset    int64   `json:"offset"`   // Fitted change in host minus device time since the first sample, in micros
+	Samples   int     `json:"samples"`
+	HostSteps int     `json:"host_steps"` // Host clock steps detected, e.g. from NTP
+}
+
+type skewSample struct {
+	device float64 // Micros since the estimator's base
+	host   float64
+}
+
+// ClockSkewEstimator continuously fits host time as a linear function of
+// device time.
+//
+// USB and network latency only ever delay the host timestamp, so each
+// second of device time contributes the sample with the smallest host
+// delay, tracing the lower envelope of the data. The line through those
+// samples is fitted robustly with a Theil–Sen slope over pairs half a
+// window apart and a median intercept.
+//
+// A run of samples that all disagree with the fit by the same large amount
+// is taken to be a step of the host clock rather than a change in the
+// device's rate, and the history is shifted to match so the fit carries on
+// undisturbed.
+type ClockSkewEstimator struct {
+	mu sync.Mutex
+
+	baseDevice int64
+	baseHost   int64
+	haveBase   bool
+
+	samples []skewSample
+	bin     int64
+	binBest *skewSample
+	pending []skewSample // Samples that disagree with the fit, awaiting confirmation as a step
+
+	slope     float64
+	intercept float64
+	hostSteps int
+	last      skewSample
+}
+
+func NewClockSkewEstimator() *ClockSkewEstimator {
+	return &ClockSkewEstimator{}
+}
+
+// Reset discards all history, e.g. when the device has restarted.
+func (e *ClockSkewEstimator) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.haveBase = false
+	e.samples = nil
+	e.binBest = nil
+	e.pending = nil
+	e.slope = 0
+	e.intercept = 0
+}
+
+// Add records that the device timestamp deviceMicros was received at host
+// time hostMicros.
+func (e *ClockSkewEstimator) Add(deviceMicros, hostMicros int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.haveBase {
+		e.baseDevice = deviceMicros
+		e.baseHost = hostMicros
+		e.haveBase = true
+	}
+	sample := skewSample{
+		device: float64(deviceMicros - e.baseDevice),
+		host:   float64(hostMicros - e.baseHost),
+	}
+	e.last = sample
+
+	bin := (deviceMicros - e.baseDevice) / skewBinMicros
+	if e.binBest != nil && bin != e.bin {
+		e.addBinSample(*e.binBest)
+		e.binBest = nil
+	}
+	e.bin = bin
+	if e.binBest == nil || sample.host-sample.device < e.binBest.host-e.binBest.device {
+		e.binBest = &sample
+	}
+}
+
+func (e *ClockSkewEstimator) addBinSample(sample skewSample) {
+	if len(e.samples) >= skewMinBins {
+		residual := sample.host - e.predict(sample.device)
+		if math.Abs(residual) > skewStepThreshold {
+			e.pending = append(e.pending, sample)
+			if len(e.pending) < skewStepConfirmBins {
+				return
+			}
+			if !e.confirmStep() {
+				// Not a consistent step, so the outliers are discarded
+				e.pending = e.pending[:0]
+			}
+			return
+		}
+		e.pending = e.pending[:0]
+	}
+
+	e.samples = append(e.samples, sample)
+	e.trim()
+	e.fit()
+}
+
+// confirmStep checks whether the pending samples agree on a host clock
+// step, and if so shifts the history onto the new host timeline.
+func (e *ClockSkewEstimator) confirmStep() bool {
+	residuals := make([]float64, len(e.pending))
+	for i, s := range e.pending {
+		residuals[i] = s.host - e.predict(s.device)
+	}
+	step := median(residuals)
+	for _, r := range residuals {
+		if math.Abs(r-step) > skewStepThreshold/2 {
+			return false
+		}
+	}
+
+	for i := range e.samples {
+		e.samples[i].host += step
+	}
+	e.samples = append(e.samples, e.pending...)
+	e.pending = e.pending[:0]
+	e.hostSteps++
+	e.trim()
+	e.fit()
+	return true
+}
+
+func (e *ClockSkewEstimator) trim() {
+	if len(e.samples) > skewWindowBins {
+		e.samples = e.samples[len(e.samples)-skewWindowBins:]
+	}
+}
+
+func (e *ClockSkewEstimator) fit() {
+	n := len(e.samples)
+	if n < 2 {
+		return
+	}
+
+	half := n / 2
+	slopes := make([]float64, 0, n-half)
+	for i := 0; i+half < n; i++ {
+		a, b := e.samples[i], e.samples[i+half]
+		if b.device != a.device {
+			slopes = append(slopes, (b.host-a.host)/(b.device-a.device))
+		}
+	}
+	if len(slopes) == 0 {
+		return
+	}
+	e.slope = median(slopes)
+
+	intercepts := make([]float64, n)
+	for i, s := range e.samples {
+		intercepts[i] = s.host - e.slope*s.device
+	}
+	e.intercept = median(intercepts)
+}
+
+func (e *ClockSkewEstimator) predict(device float64) float64 {
+	return e.intercept + e.slope*device
+}
+
+// HostTime returns the fitted host time for a device timestamp. ok is false
+// until enough data has been collected.
+func (e *ClockSkewEstimator) HostTime(deviceMicros int64) (hostMicros int64, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.samples) < skewMinBins {
+		return 0, false
+	}
+	return e.baseHost + int64(math.Round(e.predict(float64(deviceMicros-e.baseDevice)))), true
+}
+
+// Estimate returns the current fit.
+func (e *ClockSkewEstimator) Estimate() ClockSkew {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.samples) < skewMinBins {
+		return ClockSkew{Samples: len(e.samples), HostSteps: e.hostSteps}
+	}
+	return ClockSkew{
+		Valid:     true,
+		SkewPPM:   (e.slope - 1) * 1e6,
+		Offset:    int64(math.Round(e.predict(e.last.device) - e.last.device)),
+		Samples:   len(e.samples),
+		HostSteps: e.hostSteps,
+	}
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -14,6 +14,11 @@ class ClockWatcher {
         const initialTare = await this.serial.getTare();
         this.data.tareOffset = initialTare;
 
+        const clockConfig = await this.serial.getClockConfig();
+        if (clockConfig) {
+            this.data.degreesPerCount = clockConfig.degrees_per_count;
+        }
+
         // Setup WebSocket status handling
         this.ws.onStatus((status, ...args) => {
             switch (status) {
@@ -47,6 +52,12 @@ class ClockWatcher {
         
         // Setup message handling
         this.ws.onMessage((message) => {
+            // Messages for other clocks are for other pages
+            const clockId = message.ClockID || message.clock_id;
+            if (clockId && clockId !== CLOCK_ID) {
+                return;
+            }
+
             if (message.Device) {
                 this.serial.handleStatus(message);
             } else if (message.TotalMicros !== undefined) {
@@ -57,18 +68,37 @@ class ClockWatcher {
                 this.data.addBMP390Reading(message);
             } else if (message.type === 'SHT85') {
                 this.data.addSHT85Reading(message);
+            } else if (message.type === 'KINEMATICS') {
+                this.data.addKinematics(message);
+            } else if (message.type === 'CYCLE') {
+                this.data.addCycle(message);
+                this.ui.updateCycle(message);
+            } else if (message.type === 'LINK_STATS') {
+                this.ui.updateLinkStats(message);
             }
         });
         
         // Setup UI event handlers
         this.ui.onConnect(() => this.serial.connect(this.ui.getPortSelection()));
-        this.ui.onScan(() => this.serial.fetchSerialPorts());
+        this.ui.onScan(() => {
+            this.serial.fetchSerialPorts();
+            this.serial.fetchClocks();
+        });
+        this.ui.onClockChange((clockId) => {
+            window.location.search = `?clock=${encodeURIComponent(clockId)}`;
+        });
         this.ui.onTare(async () => {
             const currentValue = this.data.getCurrentPosition();
             this.data.tare();
             await this.serial.setTare(this.data.tareOffset);
             this.redraw();
         });
+        this.ui.onSyncDial(async () => {
+            const dial = await this.serial.syncDial();
+            if (dial) {
+                this.ui.updateDialError(dial.error);
+            }
+        });
         this.ui.onReset(() => {
             this.data.reset();
             this.plots.reset();
@@ -1,6 +1,7 @@
 class DataRecorder {
     constructor() {
         this.tareOffset = 0;
+        this.degreesPerCount = 2; // Quantization step, from the clock's encoder geometry
         this.mode = 'live';
         this.reset();
     }
@@ -12,9 +13,11 @@ class DataRecorder {
         this.counts = [];
         this.timestampDrifts = [];
         this.timestampDriftRates = [];
+
+        // Velocity and acceleration, smoothed by the server
+        this.kinematicsTimestamps = [];
         this.velocities = [];
         this.accelerations = [];
-        this.smoothingWindow = 20;
         
         // Peak and crossing detection
         this.lastPositivePeak = null;
@@ -31,6 +34,11 @@ class DataRecorder {
         this.amplitudeTimestamps = [];
         this.amplitudeRateData = [];
         this.amplitudeRateTimestamps = [];
+
+        // Oscillator quality and escapement drive, from the server's cycle records
+        this.qFactorData = [];
+        this.impulseData = [];
+        this.qFactorTimestamps = [];
         
         // BMP180 sensor data
         this.bmp180Temperatures = [];
@@ -117,6 +125,23 @@ class DataRecorder {
         return this.timestampDriftRates[this.timestampDriftRates.length - 1] || 0;
     }
 
+    addCycle(cycle) {
+        if (this.mode !== 'live' || this.timeOffset == null) {
+            return;
+        }
+        this.addCycleQuality(cycle, cycle.total_micros / 1000000 - this.timeOffset);
+    }
+
+    addCycleQuality(cycle, timeSeconds) {
+        // Null until the server has seen enough swings to fit
+        if (cycle.q_factor === null) {
+            return;
+        }
+        this.qFactorData.push(cycle.q_factor);
+        this.impulseData.push(cycle.impulse_fraction * 100);
+        this.qFactorTimestamps.push(timeSeconds);
+    }
+
     addReading(message) {
         if (this.mode !== 'live') {
             return null;
@@ -126,48 +151,35 @@ class DataRecorder {
         }
 
         const timeSeconds = (message.TotalMicros / 1000000) - this.timeOffset;
-        const degrees = (message.Count * 2) - this.tareOffset;
+        const degrees = message.Degrees - this.tareOffset;
 
         this.timestamps.push(timeSeconds);
         this.timestampDrifts.push(message.TimestampDrift);
         
-        if (this.timestampDrifts.length > 100) {
-            const ts0 = this.timestamps[this.timestamps.length - 99] * 1000000;
-            const ts1 = this.timestamps[this.timestamps.length - 1] * 1000000;
-
-            const esp_ts0 = this.timestampDrifts[this.timestampDrifts.length - 99] + ts0;
-            const esp_ts1 = this.timestampDrifts[this.timestampDrifts.length - 1] + ts1;
-
-            // Calculate instantaneous drift rate
-            const instantDriftRate = ((esp_ts1 - esp_ts0) / (ts1 - ts0) - 1.0) * 1000000;
-
-            // exponential moving average
-            const currentDriftRate = this.timestampDriftRates[this.timestampDriftRates.length - 1] || 0.0;
-            const k = 0.001;
-            const smoothedDriftRate = (k * instantDriftRate) + ((1 - k) * currentDriftRate);
-            
-            this.timestampDriftRates.push(smoothedDriftRate);
-        }
+        this.timestampDriftRates.push(message.SkewPPM);
         
         this.counts.push(degrees || 0);
         
         this.detectCrossingsAndPeaks();
-        
-        const currentVelocity = this.calculateVelocity();
-        this.velocities.push(currentVelocity);
-
-        const acceleration = this.calculateAcceleration();
-        this.accelerations.push(acceleration);
 
         this.trimArrays();
         
         return {
             position: degrees,
-            velocity: currentVelocity,
-            acceleration: acceleration
+            velocity: this.getCurrentVelocity(),
+            acceleration: this.getCurrentAcceleration()
         };
     }
 
+    addKinematics(message) {
+        if (this.mode !== 'live' || this.timeOffset == null) {
+            return;
+        }
+        this.kinematicsTimestamps.push(message.total_micros / 1000000 - this.timeOffset);
+        this.velocities.push(message.velocity);
+        this.accelerations.push(message.acceleration);
+    }
+
     addBMP180Reading(message) {
         if (this.mode !== 'live') {
             return;
@@ -237,26 +249,6 @@ class DataRecorder {
         }
     }
 
-    calculateFiniteDifference(array, step) {
-        if (array.length < step + 1) return 0;
-        
-        // Use the most recent point and a point 'step' positions back
-        const dt = this.timestamps[this.timestamps.length - 1] - 
-                  this.timestamps[this.timestamps.length - step];
-        const dy = array[array.length - 1] - 
-                  array[array.length - step];
-        
-        return dy / dt;
-    }
-
-    calculateVelocity() {
-        return this.calculateFiniteDifference(this.counts, 10);
-    }
-
-    calculateAcceleration() {
-        return this.calculateFiniteDifference(this.velocities, 10);
-    }
-
     detectCrossingsAndPeaks() {
         const n = this.counts.length;
         if (n < 2) return;
@@ -339,12 +331,12 @@ class DataRecorder {
 
         // Detect positive peak
         if (middlePoint > prevPoint && middlePoint > currentPoint && middlePoint > 0) {
-            // For positive peak, add 2 degrees to currentPoint because we were likely
+            // For positive peak, add one count to currentPoint because we were likely
             // exactly at the higher quantization level when we started dropping
             const interpolated = this.interpolatePeak(
                 prevPoint, 
                 middlePoint, 
-                currentPoint + 2, 
+                currentPoint + this.degreesPerCount, 
                 prevTime, 
                 middleTime, 
                 currentTime,
@@ -354,11 +346,11 @@ class DataRecorder {
         }
         // Detect negative peak
         else if (middlePoint < prevPoint && middlePoint < currentPoint && middlePoint < 0) {
-            // For negative peak, add 2 degrees to prevPoint and middlePoint because
+            // For negative peak, add one count to prevPoint and middlePoint because
             // they were likely exactly at the lower quantization level
             const interpolated = this.interpolatePeak(
-                prevPoint + 2, 
-                middlePoint + 2, 
+                prevPoint + this.degreesPerCount, 
+                middlePoint + this.degreesPerCount, 
                 currentPoint, 
                 prevTime, 
                 middleTime, 
@@ -391,8 +383,8 @@ class DataRecorder {
         const pPeak = a * xPeak * xPeak + b * xPeak + p2;
         
         // Only return result if peak is within the time interval AND
-        // if the interpolated peak is within 4 units of the middle value
-        if (tPeak >= t1 && tPeak <= t3 && Math.abs(pPeak - p2) <= 4) {
+        // if the interpolated peak is within two counts of the middle value
+        if (tPeak >= t1 && tPeak <= t3 && Math.abs(pPeak - p2) <= 2 * this.degreesPerCount) {
             return { time: tPeak, position: pPeak };
         }
         
@@ -405,6 +397,7 @@ class DataRecorder {
         this.counts = this.counts.slice(-this.maxPoints);
         this.timestampDrifts = this.timestampDrifts.slice(-this.maxPoints);
         this.timestampDriftRates = this.timestampDriftRates.slice(-this.maxPoints);
+        this.kinematicsTimestamps = this.kinematicsTimestamps.slice(-this.maxPoints);
         this.velocities = this.velocities.slice(-this.maxPoints);
         this.accelerations = this.accelerations.slice(-this.maxPoints);
         this.amplitudeData = this.amplitudeData.slice(-this.maxPoints);
@@ -413,6 +406,9 @@ class DataRecorder {
         this.amplitudeRateTimestamps = this.amplitudeRateTimestamps.slice(-this.maxPoints);
         this.periodData = this.periodData.slice(-this.maxPoints);
         this.periodTimestamps = this.periodTimestamps.slice(-this.maxPoints);
+        this.qFactorData = this.qFactorData.slice(-this.maxPoints);
+        this.impulseData = this.impulseData.slice(-this.maxPoints);
+        this.qFactorTimestamps = this.qFactorTimestamps.slice(-this.maxPoints);
         
         // Trim environmental sensor arrays
         this.bmp180Temperatures = this.bmp180Temperatures.slice(-this.maxPoints);
@@ -431,13 +427,36 @@ class DataRecorder {
         }
     }
 
+    // Stands in for a cycle record with the means of a bucket of them
+    bucketMeans(bucket) {
+        const point = { total_micros: bucket.total_micros };
+        for (const [column, stats] of Object.entries(bucket.columns)) {
+            point[column] = stats.mean;
+        }
+        return point;
+    }
+
     async loadHistoricalData(startTime, endTime) {
         try {
-            const response = await fetch(`/historical_data?start=${startTime}&end=${endTime}`);
+            // Ranges with more cycles than we keep are averaged by the server
+            // into buckets, and the rest are shown cycle by cycle
+            const query = `/historical_data?clock=${encodeURIComponent(CLOCK_ID)}&start=${startTime}&end=${endTime}`;
+            let response = await fetch(`${query}&points=${this.maxPoints}`);
             if (!response.ok) {
                 throw new Error(`HTTP error! status: ${response.status}`);
             }
-            const data = await response.json();
+            const buckets = await response.json();
+            const cycles = buckets ? buckets.reduce((total, bucket) => total + bucket.count, 0) : 0;
+            let data;
+            if (cycles > this.maxPoints) {
+                data = buckets.map(bucket => this.bucketMeans(bucket));
+            } else {
+                response = await fetch(query);
+                if (!response.ok) {
+                    throw new Error(`HTTP error! status: ${response.status}`);
+                }
+                data = await response.json();
+            }
             
             // Reset arrays before loading historical data
             this.reset();
@@ -457,6 +476,7 @@ class DataRecorder {
                 // Add timestamp data
                 this.timestamps.push(timeSeconds - this.timeOffset);
                 this.timestampDrifts.push(point.timestamp_drift);
+                this.timestampDriftRates.push(point.clock_skew_ppm);
 
                 // Add amplitude and period data
                 if (point.amplitude !== null) {
@@ -467,6 +487,7 @@ class DataRecorder {
                     this.periodData.push(point.period);
                     this.periodTimestamps.push(timeSeconds - this.timeOffset);
                 }
+                this.addCycleQuality(point, timeSeconds - this.timeOffset);
 
                 // Add environmental data
                 if (point.bmp180_temperature !== null) {
@@ -8,8 +8,6 @@ class Plots {
 
     reset() {
         // Store the averaged arrays
-        this.avgVelocities = [];
-        this.avgAccelerations = [];
         this.avgAmplitude = [];
         this.avgPeriod = [];
         this.avgAmplitudeRate = [];
@@ -17,8 +15,6 @@ class Plots {
         
         // Store previous lengths to detect resets
         this.prevLengths = {
-            velocities: 0,
-            accelerations: 0,
             amplitudeData: 0,
             periodData: 0,
             amplitudeRateData: 0,
@@ -155,6 +151,18 @@ class Plots {
             xAxisTitle: 'Time (s)',
             yAxisTitle: 'Amplitude Rate (degrees/s)'
         });
+        createPlot({
+            elementId: 'q-factor-chart',
+            title: 'Q Factor',
+            xAxisTitle: 'Time (s)',
+            yAxisTitle: 'Q'
+        });
+        createPlot({
+            elementId: 'impulse-chart',
+            title: 'Impulse Energy',
+            xAxisTitle: 'Time (s)',
+            yAxisTitle: 'Energy per impulse (% of swing)'
+        });
         createPlot({
             elementId: 'amplitude-period-chart-avg',
             title: 'Amplitude vs Period',
@@ -240,21 +248,6 @@ class Plots {
     }
 
     updateAll(data) {
-        // Update moving averages incrementally
-        this.avgVelocities = this.updateMovingAverage(
-            data.velocities, 
-            this.avgVelocities, 
-            data.smoothingWindow, 
-            this.prevLengths.velocities
-        );
-        
-        this.avgAccelerations = this.updateMovingAverage(
-            data.accelerations, 
-            this.avgAccelerations, 
-            data.smoothingWindow, 
-            this.prevLengths.accelerations
-        );
-
         let avgWindow = document.getElementById('avg-window').value;
         const isAveragingEnabled = document.getElementById('avg-enabled').checked;
         if (!isAveragingEnabled) {
@@ -300,8 +293,6 @@ class Plots {
 
         // Update previous lengths
         this.prevLengths = {
-            velocities: data.velocities.length,
-            accelerations: data.accelerations.length,
             amplitudeData: data.amplitudeData.length,
             periodData: data.periodData.length,
             amplitudeRateData: data.amplitudeRateData.length,
@@ -316,13 +307,13 @@ class Plots {
             },
             { 
                 id: 'velocity-chart', 
-                x: [data.timestamps], 
-                y: [this.avgVelocities] 
+                x: [data.kinematicsTimestamps], 
+                y: [data.velocities] 
             },
             { 
                 id: 'acceleration-chart', 
-                x: [data.timestamps], 
-                y: [this.avgAccelerations] 
+                x: [data.kinematicsTimestamps], 
+                y: [data.accelerations] 
             },
             { 
                 id: 'period-chart-avg', 
@@ -339,6 +330,16 @@ class Plots {
                 x: [data.amplitudeRateTimestamps], 
                 y: [this.avgAmplitudeRate] 
             },
+            {
+                id: 'q-factor-chart',
+                x: [data.qFactorTimestamps],
+                y: [data.qFactorData]
+            },
+            {
+                id: 'impulse-chart',
+                x: [data.qFactorTimestamps],
+                y: [data.impulseData]
+            },
             { 
                 id: 'amplitude-period-chart-avg', 
                 x: [this.avgAmplitude], 
@@ -358,7 +359,7 @@ class Plots {
             /*{ 
                 id: 'position-velocity-chart', 
                 x: [data.counts], 
-                y: [this.avgVelocities] 
+                y: [data.velocities] 
             },*/
             { 
                 id: 'temperature-chart', 
@@ -1,3 +1,6 @@
+// The clock this page shows, chosen with ?clock= in the page URL
+const CLOCK_ID = new URLSearchParams(window.location.search).get('clock') || 'default';
+
 class SerialManager {
     constructor(ui) {
         this.ui = ui;
@@ -19,11 +22,24 @@ class SerialManager {
         }
     }
     
+    async fetchClocks() {
+        try {
+            const response = await fetch('/clocks');
+            if (!response.ok) {
+                throw new Error('Failed to fetch clocks');
+            }
+            const clocks = await response.json();
+            this.ui.updateClocks(clocks || [], CLOCK_ID);
+        } catch (error) {
+            console.error('Error fetching clocks:', error);
+        }
+    }
+
     async connect(portName) {
         if (!portName) return;
 
         try {
-            const response = await fetch('/connect', {
+            const response = await fetch(`/connect?clock=${encodeURIComponent(CLOCK_ID)}`, {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
@@ -61,6 +77,16 @@ class SerialManager {
             OVERFLOW: () => {
                 this.ui.updateSerialStatus('Serial: Buffer Overflow', true);
             },
+            RECONNECTING: (status) => {
+                this.connected = false;
+                this.ui.updateSerialStatus(`Serial: Reconnecting (${status.Error})`, true);
+            },
+            SEQUENCE_GAP: (status) => {
+                this.ui.updateSerialStatus(`Serial: Lost steps - ${status.Error}`, true);
+            },
+            RESYNC: (status) => {
+                console.warn('Serial frame resync:', status.Error);
+            },
             ERROR: (status) => {
                 this.handleError(status.Error);
             }
@@ -89,7 +115,7 @@ class SerialManager {
     
     async setTare(value) {
         try {
-            const response = await fetch('/tare', {
+            const response = await fetch(`/tare?clock=${encodeURIComponent(CLOCK_ID)}`, {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
@@ -104,9 +130,41 @@ class SerialManager {
         }
     }
     
+    async getClockConfig() {
+        try {
+            const response = await fetch(`/clock_config?clock=${encodeURIComponent(CLOCK_ID)}`);
+            if (!response.ok) {
+                throw new Error('Failed to get clock config');
+            }
+            return await response.json();
+        } catch (error) {
+            console.error('Error getting clock config:', error);
+            return null;
+        }
+    }
+
+    async syncDial() {
+        try {
+            const response = await fetch(`/dial?clock=${encodeURIComponent(CLOCK_ID)}`, {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                },
+                body: JSON.stringify({ time: Date.now() * 1000 }),
+            });
+            if (!response.ok) {
+                throw new Error('Failed to set dial');
+            }
+            return await response.json();
+        } catch (error) {
+            console.error('Error setting dial:', error);
+            return null;
+        }
+    }
+
     async getTare() {
         try {
-            const response = await fetch('/tare');
+            const response = await fetch(`/tare?clock=${encodeURIComponent(CLOCK_ID)}`);
             if (!response.ok) {
                 throw new Error('Failed to get tare');
             }
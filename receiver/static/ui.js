@@ -13,10 +13,12 @@ class UI {
         const elements = {
             serialStatus: document.getElementById('serial-status'),
             wsStatus: document.getElementById('ws-status'),
+            clockSelect: document.getElementById('clock-select'),
             serialPortsSelect: document.getElementById('serial-ports'),
             connectBtn: document.getElementById('connect-btn'),
             scanBtn: document.getElementById('scan-btn'),
             tareBtn: document.getElementById('tare-btn'),
+            syncDialBtn: document.getElementById('sync-dial-btn'),
             resetBtn: document.getElementById('reset-btn'),
             avgWindow: document.getElementById('avg-window'),
             avgEnabled: document.getElementById('avg-enabled'),
@@ -34,7 +36,15 @@ class UI {
                 currentTemperatureSHT85: document.getElementById('current-temperature-sht85'),
                 currentPressure: document.getElementById('current-pressure'),
                 currentPressureBMP390: document.getElementById('current-pressure-bmp390'),
-                currentHumidity: document.getElementById('current-humidity')
+                currentHumidity: document.getElementById('current-humidity'),
+                currentBeatError: document.getElementById('current-beat-error'),
+                currentRate: document.getElementById('current-rate'),
+                currentRateInstant: document.getElementById('current-rate-instant'),
+                currentDialError: document.getElementById('current-dial-error'),
+                currentImpulse: document.getElementById('current-impulse'),
+                currentImpulseTiming: document.getElementById('current-impulse-timing'),
+                linkFps: document.getElementById('link-fps'),
+                linkErrors: document.getElementById('link-errors')
             },
             modeControls: {
                 liveMode: document.querySelector('input[value="live"]'),
@@ -125,6 +135,10 @@ class UI {
         this.elements.connectBtn.addEventListener('click', callback);
     }
     
+    onClockChange(callback) {
+        this.elements.clockSelect.addEventListener('change', () => callback(this.elements.clockSelect.value));
+    }
+
     onScan(callback) {
         this.elements.scanBtn.addEventListener('click', callback);
     }
@@ -133,6 +147,10 @@ class UI {
         this.elements.tareBtn.addEventListener('click', callback);
     }
     
+    onSyncDial(callback) {
+        this.elements.syncDialBtn.addEventListener('click', callback);
+    }
+
     onReset(callback) {
         this.elements.resetBtn.addEventListener('click', callback);
     }
@@ -164,6 +182,21 @@ class UI {
         displays.currentHumidity.textContent = `${data.getCurrentSHT85Humidity().toFixed(2)} %`;
     }
     
+    updateClocks(clocks, currentId) {
+        this.elements.clockSelect.innerHTML = '';
+        const ids = clocks.map(clock => clock.id);
+        if (!ids.includes(currentId)) {
+            ids.push(currentId);
+        }
+        ids.forEach(id => {
+            const option = document.createElement('option');
+            option.value = id;
+            option.textContent = `Clock: ${id}`;
+            option.selected = id === currentId;
+            this.elements.clockSelect.appendChild(option);
+        });
+    }
+
     updateSerialPorts(ports) {
         this.elements.serialPortsSelect.innerHTML = '';
         ports.forEach(port => {
@@ -184,6 +217,44 @@ class UI {
         this.elements.wsStatus.className = isError ? 'status-error' : 'status-success';
     }
 
+    updateCycle(cycle) {
+        const displays = this.elements.displays;
+        displays.currentBeatError.textContent = `${cycle.beat_error.toFixed(2)} ms`;
+
+        // Rates are null until the clock has a nominal period
+        if (cycle.rate_smoothed !== null) {
+            displays.currentRate.textContent = `${cycle.rate_smoothed >= 0 ? '+' : ''}${cycle.rate_smoothed.toFixed(1)} s/day`;
+        }
+        if (cycle.rate !== null) {
+            displays.currentRateInstant.textContent = `now ${cycle.rate >= 0 ? '+' : ''}${cycle.rate.toFixed(1)}`;
+        }
+        if (cycle.accumulated_error !== null) {
+            this.updateDialError(cycle.accumulated_error);
+        }
+
+        // Impulse timing is relative to the zero crossing, and null when no
+        // impulse was found in the beat
+        if (cycle.impulse_magnitude !== null) {
+            displays.currentImpulse.textContent = `${cycle.impulse_magnitude.toFixed(2)}°`;
+            displays.currentImpulseTiming.textContent =
+                `unlock ${cycle.unlock_time.toFixed(1)} ms, drop ${cycle.drop_time >= 0 ? '+' : ''}${cycle.drop_time.toFixed(1)} ms`;
+        }
+    }
+
+    // The dial error is null until the hands have been set
+    updateDialError(error) {
+        this.elements.displays.currentDialError.textContent =
+            error === null ? '-- s' : `${error >= 0 ? '+' : ''}${error.toFixed(1)} s`;
+    }
+
+    updateLinkStats(stats) {
+        const displays = this.elements.displays;
+        displays.linkFps.textContent = `${stats.frames_per_second.toFixed(0)} fps`;
+        displays.linkErrors.textContent =
+            `${stats.checksum_failures} checksum, ${stats.resyncs} resync, ` +
+            `${stats.overflow_markers} overflow, ${stats.backpressure_stalls} stalls`;
+    }
+
     handleModeChange(mode) {
         // Show/hide time bounds controls
         this.elements.modeControls.timeBounds.style.display = mode === 'historical' ? 'block' : 'none';
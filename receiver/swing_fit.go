@@ -0,0 +1,256 @@
+package receiver
+
+import (
+	"math"
+)
+
+const (
+	swingFitMinSamples = 8
+	swingFitMaxSamples = 100000 // Give up on a swing that never crosses zero
+	swingFitIterations = 40
+)
+
+// swingSample is the time at which the encoder passed an edge, and the
+// angle of that edge.
+type swingSample struct {
+	t       float64 // Micros
+	degrees float64
+}
+
+// SwingFit is a least-squares fit of one half-swing, from one zero crossing
+// to the next, to a sinusoid about an offset equilibrium:
+//
+//	θ(t) = c + R·sin(ω·t + φ)
+//
+// Every encoder edge in the swing contributes, so unlike the three-point
+// peak interpolation it isn't thrown by plateaus at the turning point.
+type SwingFit struct {
+	Sign        int     // 1 for a swing on the positive side, -1 for negative
+	Start       float64 // Fitted zero crossing starting the swing, in micros
+	Peak        float64 // Fitted turning point, in micros
+	End         float64 // Fitted zero crossing ending the swing, in micros
+	Position    float64 // Angle at the turning point, in degrees
+	Equilibrium float64 // Fitted c, in degrees
+	Omega       float64 // Fitted ω, in radians per second
+	Residual    float64 // RMS residual, in degrees
+	Samples     int
+}
+
+// Duration returns the time the swing spent on its side of zero, in
+// seconds.
+func (f *SwingFit) Duration() float64 {
+	return (f.End - f.Start) / 1e6
+}
+
+// fitSwing fits the samples of one half-swing. ω is found by a golden
+// section search, solving for c, R and φ by linear least squares at each
+// trial ω.
+func fitSwing(samples []swingSample) *SwingFit {
+	n := len(samples)
+	if n < swingFitMinSamples {
+		return nil
+	}
+
+	// Work in seconds about the middle of the swing, for conditioning
+	t0 := (samples[0].t + samples[n-1].t) / 2
+	span := (samples[n-1].t - samples[0].t) / 1e6
+	if span <= 0 {
+		return nil
+	}
+	ts := make([]float64, n)
+	var mean float64
+	for i, s := range samples {
+		ts[i] = (s.t - t0) / 1e6
+		mean += s.degrees
+	}
+	sign := 1
+	if mean < 0 {
+		sign = -1
+	}
+
+	// The swing spans roughly half a period
+	omega0 := math.Pi / span
+	lo, hi := 0.7*omega0, 1.4*omega0
+	golden := (math.Sqrt(5) - 1) / 2
+	x1 := hi - golden*(hi-lo)
+	x2 := lo + golden*(hi-lo)
+	_, f1 := fitSinusoid(ts, samples, x1)
+	_, f2 := fitSinusoid(ts, samples, x2)
+	for i := 0; i < swingFitIterations; i++ {
+		if f1 < f2 {
+			hi, x2, f2 = x2, x1, f1
+			x1 = hi - golden*(hi-lo)
+			_, f1 = fitSinusoid(ts, samples, x1)
+		} else {
+			lo, x1, f1 = x1, x2, f2
+			x2 = lo + golden*(hi-lo)
+			_, f2 = fitSinusoid(ts, samples, x2)
+		}
+	}
+	omega := (lo + hi) / 2
+	coeffs, ssr := fitSinusoid(ts, samples, omega)
+	if math.IsNaN(ssr) {
+		return nil
+	}
+
+	c, a, b := coeffs[0], coeffs[1], coeffs[2]
+	r := math.Hypot(a, b)
+	phi := math.Atan2(b, a)
+	if r == 0 || math.Abs(c) >= r {
+		return nil
+	}
+
+	// Turning point at ωt + φ = ±π/2, taking the one nearest the middle
+	peakPhase := float64(sign) * math.Pi / 2
+	tPeak := (peakPhase - phi) / omega
+	cycle := 2 * math.Pi / omega
+	tPeak -= cycle * math.Round(tPeak/cycle)
+
+	// The crossings are where sin(ωt + φ) = -c/R, either side of the peak
+	halfWidth := math.Pi/2 + float64(sign)*math.Asin(c/r)
+
+	return &SwingFit{
+		Sign:        sign,
+		Start:       t0 + (tPeak-halfWidth/omega)*1e6,
+		Peak:        t0 + tPeak*1e6,
+		End:         t0 + (tPeak+halfWidth/omega)*1e6,
+		Position:    c + float64(sign)*r,
+		Equilibrium: c,
+		Omega:       omega,
+		Residual:    math.Sqrt(ssr / float64(n)),
+		Samples:     n,
+	}
+}
+
+// fitSinusoid solves for c, a and b in c + a·sin(ωt) + b·cos(ωt) by least
+// squares, returning them and the sum of squared residuals.
+func fitSinusoid(ts []float64, samples []swingSample, omega float64) ([]float64, float64) {
+	ata := [][]float64{make([]float64, 3), make([]float64, 3), make([]float64, 3)}
+	aty := make([]float64, 3)
+	for i, t := range ts {
+		row := [3]float64{1, math.Sin(omega * t), math.Cos(omega * t)}
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				ata[j][k] += row[j] * row[k]
+			}
+			aty[j] += row[j] * samples[i].degrees
+		}
+	}
+
+	coeffs, ok := solveLinear(ata, aty)
+	if !ok {
+		return nil, math.NaN()
+	}
+
+	var ssr float64
+	for i, t := range ts {
+		residual := samples[i].degrees - (coeffs[0] + coeffs[1]*math.Sin(omega*t) + coeffs[2]*math.Cos(omega*t))
+		ssr += residual * residual
+	}
+	return coeffs, ssr
+}
+
+// solveLinear solves a square linear system by Gaussian elimination with
+// partial pivoting. a and b are left unchanged.
+func solveLinear(a [][]float64, b []float64) ([]float64, bool) {
+	n := len(b)
+	a = append([][]float64(nil), a...)
+	for i := range a {
+		a[i] = append([]float64(nil), a[i]...)
+	}
+	b = append([]float64(nil), b...)
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if a[pivot][col] == 0 {
+			return nil, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+
+		for row := col + 1; row < n; row++ {
+			factor := a[row][col] / a[col][col]
+			for k := col; k < n; k++ {
+				a[row][k] -= factor * a[col][k]
+			}
+			b[row] -= factor * b[col]
+		}
+	}
+	x := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := b[row]
+		for k := row + 1; k < n; k++ {
+			sum -= a[row][k] * x[k]
+		}
+		x[row] = sum / a[row][row]
+	}
+	return x, true
+}
+
+// edgeSample returns the edge the encoder passed for reading.
+func (dr *DataRecorder) edgeSample(reading, prevReading Reading) swingSample {
+	return swingSample{
+		t:       float64(reading.TotalMicros),
+		degrees: dr.geometry.EdgeDegrees(reading.Count, reading.Count > prevReading.Count),
+	}
+}
+
+// addSwingSample records the edge for the latest reading, and when the
+// reading completed a half-swing, fits it.
+func (dr *DataRecorder) addSwingSample(sample swingSample, reading, prevReading Reading, crossing bool) {
+	if !crossing {
+		if len(dr.swingSamples) >= swingFitMaxSamples {
+			dr.swingSamples = dr.swingSamples[:0]
+		}
+		dr.swingSamples = append(dr.swingSamples, sample)
+		return
+	}
+
+	// Include the first sample past the crossing, so both ends of the swing
+	// are pinned down
+	swing := append(dr.swingSamples, sample)
+	fit := fitSwing(swing)
+	dr.findImpulse(swing, fit)
+	if fit != nil && fit.Sign > 0 {
+		dr.lastPositiveFit = fit
+	} else if fit != nil {
+		dr.lastNegativeFit = fit
+	} else if reading.Count > prevReading.Count {
+		dr.lastNegativeFit = nil // Don't pair the next swing with an older one
+	} else {
+		dr.lastPositiveFit = nil
+	}
+
+	var prev swingSample
+	if n := len(dr.swingSamples); n > 0 {
+		prev = dr.swingSamples[n-1]
+	}
+	dr.swingSamples = append(dr.swingSamples[:0], prev, sample)
+	if prev.t == 0 {
+		dr.swingSamples = dr.swingSamples[1:]
+	}
+}
+
+// addSwingFits fills in the cycle's fitted values from the last two
+// swings, if both were fitted and belong to the same cycle.
+func (dr *DataRecorder) addSwingFits(cycle *HistoricalData) {
+	pos, neg := dr.lastPositiveFit, dr.lastNegativeFit
+	if pos == nil || neg == nil || math.Abs(pos.Peak-neg.Peak)/1e6 > cycle.Period {
+		return
+	}
+
+	period := pos.Duration() + neg.Duration()
+	amplitude := pos.Position - neg.Position
+	// The positive-going half period is the swing on the negative side
+	beatError := (neg.Duration() - pos.Duration()) / 2 * 1000
+	residual := math.Sqrt((pos.Residual*pos.Residual + neg.Residual*neg.Residual) / 2)
+
+	cycle.FitPeriod = &period
+	cycle.FitAmplitude = &amplitude
+	cycle.FitBeatError = &beatError
+	cycle.FitResidual = &residual
+}
@@ -0,0 +1,211 @@
+package receiver
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	traceChunkEvents      = 4096
+	traceChunkMicros      = 10000000 // Longest span of device time in one chunk
+	traceMaxPoints        = 200000   // Most points returned by one query
+	DefaultTraceRetention = 24 * time.Hour
+)
+
+// The raw trace keeps every step event, so that any swing can be examined
+// after the fact. At a few hundred events per second a row per event would
+// soon dwarf the rest of the database, so events are stored in chunks of
+// up to traceChunkEvents, each a blob of varint deltas from the previous
+// event: device micros, count, and host minus device micros. That comes to
+// about four bytes per event.
+
+type traceEvent struct {
+	device uint64 // TotalMicros
+	drift  int64  // TimestampDrift, host minus device time
+	count  int    // Position corrected for lost steps, before tare
+}
+
+// TracePoint is one step event from the raw trace, with the velocity and
+// acceleration found by the clock's Savitzky–Golay filter. Those are null
+// within half a filter window of the ends of the trace and of any jump in
+// the count.
+type TracePoint struct {
+	TotalMicros  uint64   `json:"total_micros"`
+	HostMicros   int64    `json:"host_micros"`
+	Count        int      `json:"count"`
+	Degrees      float64  `json:"degrees"`
+	Velocity     *float64 `json:"velocity"`
+	Acceleration *float64 `json:"acceleration"`
+}
+
+func encodeTrace(events []traceEvent) []byte {
+	data := make([]byte, 0, 4*len(events))
+	prev := traceEvent{device: events[0].device}
+	for _, e := range events {
+		data = binary.AppendVarint(data, int64(e.device-prev.device))
+		data = binary.AppendVarint(data, int64(e.count-prev.count))
+		data = binary.AppendVarint(data, e.drift-prev.drift)
+		prev = e
+	}
+	return data
+}
+
+func decodeTrace(start uint64, data []byte, n int) ([]traceEvent, error) {
+	events := make([]traceEvent, 0, n)
+	prev := traceEvent{device: start}
+	for len(data) > 0 {
+		var deltas [3]int64
+		for i := range deltas {
+			d, size := binary.Varint(data)
+			if size <= 0 {
+				return events, errors.New("corrupt trace chunk")
+			}
+			deltas[i] = d
+			data = data[size:]
+		}
+		prev = traceEvent{
+			device: prev.device + uint64(deltas[0]),
+			count:  prev.count + int(deltas[1]),
+			drift:  prev.drift + deltas[2],
+		}
+		events = append(events, prev)
+	}
+	return events, nil
+}
+
+// SetTraceRetention sets how long raw step events are kept for. Zero stops
+// them being recorded. The old ones are removed by pruneDatabase.
+func (dr *DataRecorder) SetTraceRetention(retention time.Duration) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	dr.traceRetention = retention
+}
+
+// addTraceEvent queues a reading's step event, writing out the chunk when
+// it's full.
+func (dr *DataRecorder) addTraceEvent(reading Reading) {
+	if dr.traceRetention <= 0 {
+		return
+	}
+	if n := len(dr.traceEvents); n > 0 {
+		first, last := dr.traceEvents[0], dr.traceEvents[n-1]
+		// A device restart starts a new chunk, as time goes backwards
+		if n >= traceChunkEvents || reading.TotalMicros < last.device || reading.TotalMicros-first.device >= traceChunkMicros {
+			dr.flushTrace()
+		}
+	}
+	dr.traceEvents = append(dr.traceEvents, traceEvent{
+		device: reading.TotalMicros,
+		drift:  reading.TimestampDrift,
+		count:  reading.Count,
+	})
+}
+
+// flushTrace writes the queued events as a chunk.
+func (dr *DataRecorder) flushTrace() error {
+	n := len(dr.traceEvents)
+	if n == 0 {
+		return nil
+	}
+	first, last := dr.traceEvents[0], dr.traceEvents[n-1]
+	hostEnd := int64(last.device) + last.drift
+	clockID, data := dr.clockID, encodeTrace(dr.traceEvents)
+	dr.traceEvents = dr.traceEvents[:0]
+	return dr.write("trace", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT INTO trace (clock_id, start_micros, end_micros, host_end, events, data)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, clockID, first.device, last.device, hostEnd, n, data)
+		return err
+	})
+}
+
+// GetTrace returns the step events recorded between startTime and endTime,
+// in device micros. truncated is set if there were more than
+// traceMaxPoints, in which case the earliest are returned.
+func (dr *DataRecorder) GetTrace(startTime, endTime int64) (points []TracePoint, truncated bool, err error) {
+	// Events not yet written out are included
+	dr.mu.Lock()
+	pending := append([]traceEvent(nil), dr.traceEvents...)
+	geometry := dr.geometry
+	window, order := dr.config.KinematicsWindow, dr.config.KinematicsOrder
+	dr.mu.Unlock()
+
+	rows, err := dr.db.Query(`
+		SELECT start_micros, events, data
+		FROM trace
+		WHERE clock_id = ? AND start_micros <= ? AND end_micros >= ?
+		ORDER BY start_micros ASC
+	`, dr.clockID, endTime, startTime)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var events []traceEvent
+	add := func(chunk []traceEvent) {
+		for _, e := range chunk {
+			if int64(e.device) < startTime || int64(e.device) > endTime {
+				continue
+			}
+			if len(events) >= traceMaxPoints {
+				truncated = true
+				return
+			}
+			events = append(events, e)
+		}
+	}
+	for rows.Next() && !truncated {
+		var start uint64
+		var n int
+		var data []byte
+		if err := rows.Scan(&start, &n, &data); err != nil {
+			return nil, false, err
+		}
+		chunk, err := decodeTrace(start, data, n)
+		if err != nil {
+			return nil, false, err
+		}
+		add(chunk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if !truncated && len(pending) > 0 && (len(events) == 0 || pending[0].device > events[len(events)-1].device) {
+		add(pending)
+	}
+
+	points = make([]TracePoint, len(events))
+	var filter kinematicsFilter
+	for i, e := range events {
+		points[i] = TracePoint{
+			TotalMicros: e.device,
+			HostMicros:  int64(e.device) + e.drift,
+			Count:       e.count,
+			Degrees:     geometry.Degrees(float64(e.count)),
+		}
+
+		// The first event is taken to be moving the same way as the second
+		var up bool
+		switch {
+		case i > 0:
+			step := e.count - events[i-1].count
+			if step != 1 && step != -1 {
+				filter.reset() // Lost steps or a re-zero
+			}
+			up = step > 0
+		case len(events) > 1:
+			up = events[1].count > e.count
+		}
+		sample := swingSample{t: float64(e.device), degrees: geometry.EdgeDegrees(e.count, up)}
+		if k := filter.add(sample, window, order); k != nil && !math.IsNaN(k.Velocity) {
+			centre := &points[i-window/2]
+			centre.Velocity = &k.Velocity
+			centre.Acceleration = &k.Acceleration
+		}
+	}
+	return points, truncated, nil
+}
@@ -0,0 +1,181 @@
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+const (
+	TransportSerial    = "serial"
+	TransportTCP       = "tcp"        // Dial out to the encoder
+	TransportTCPListen = "tcp-listen" // Wait for the encoder to connect to us
+	TransportUDP       = "udp"        // Receive frames as UDP datagrams
+)
+
+// Transport is a byte stream carrying encoder frames. serial.Port and
+// net.Conn both satisfy it.
+type Transport interface {
+	io.Reader
+	io.Closer
+}
+
+// transportClock is implemented by transports that supply their own host
+// timeline, such as replays and simulations.
+type transportClock interface {
+	Now() int64
+}
+
+// TransportConfig selects and configures the encoder input.
+type TransportConfig struct {
+	Type      string           `json:"transport"`
+	PortName  string           `json:"port_name"`
+	BaudRate  int              `json:"baud_rate"`
+	Address   string           `json:"address"`
+	Simulator *SimulatorConfig `json:"simulator,omitempty"`
+}
+
+func (tc TransportConfig) String() string {
+	switch tc.Type {
+	case "", TransportSerial:
+		return fmt.Sprintf("%s at %d baud", tc.PortName, tc.BaudRate)
+	case TransportSimulator:
+		return "simulator"
+	default:
+		return fmt.Sprintf("%s %s", tc.Type, tc.Address)
+	}
+}
+
+// OpenTransport opens the encoder input described by tc.
+func OpenTransport(tc TransportConfig) (Transport, error) {
+	switch tc.Type {
+	case "", TransportSerial:
+		return serial.Open(tc.PortName, &serial.Mode{BaudRate: tc.BaudRate})
+
+	case TransportTCP:
+		return net.DialTimeout("tcp", tc.Address, 5*time.Second)
+
+	case TransportTCPListen:
+		listener, err := net.Listen("tcp", tc.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &tcpListenTransport{listener: listener}, nil
+
+	case TransportUDP:
+		addr, err := net.ResolveUDPAddr("udp", tc.Address)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return &udpTransport{conn: conn}, nil
+
+	case TransportSimulator:
+		config := DefaultSimulatorConfig()
+		if tc.Simulator != nil {
+			config = *tc.Simulator
+		}
+		return NewSimulator(config), nil
+
+	default:
+		return nil, fmt.Errorf("unknown transport %q", tc.Type)
+	}
+}
+
+// tcpListenTransport accepts one encoder connection at a time and moves on
+// to the next connection when the current one drops, so the encoder can
+// reconnect without the reader noticing anything but a resync.
+type tcpListenTransport struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conn     net.Conn
+	closed   bool
+}
+
+func (t *tcpListenTransport) Read(p []byte) (int, error) {
+	for {
+		conn, err := t.currentConn()
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := conn.Read(p)
+		if err != nil {
+			t.dropConn(conn)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (t *tcpListenTransport) currentConn() (net.Conn, error) {
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	conn, err := t.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		conn.Close()
+		return nil, errors.New("transport closed")
+	}
+	t.conn = conn
+	return conn, nil
+}
+
+func (t *tcpListenTransport) dropConn(conn net.Conn) {
+	conn.Close()
+	t.mu.Lock()
+	if t.conn == conn {
+		t.conn = nil
+	}
+	t.mu.Unlock()
+}
+
+func (t *tcpListenTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+	t.mu.Unlock()
+	return t.listener.Close()
+}
+
+// udpTransport returns one datagram per read. Datagrams should carry whole
+// frames, but the frame decoder copes if they don't.
+type udpTransport struct {
+	conn *net.UDPConn
+}
+
+func (t *udpTransport) Read(p []byte) (int, error) {
+	for {
+		n, err := t.conn.Read(p)
+		if n > 0 || err != nil {
+			return n, err
+		}
+		// Ignore empty datagrams, which SerialReader would take as end of stream
+	}
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
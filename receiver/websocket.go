@@ -60,12 +60,13 @@ func (s *WebSocketServer) handleConnections(w http.ResponseWriter, r *http.Reque
 	s.clients[ws] = true
 	s.clientsMux.Unlock()
 
-	// Send initial serial status
+	// Send initial serial status of every clock
 	if s.server != nil {
-		status := s.server.getCurrentSerialStatus()
-		message, err := json.Marshal(status)
-		if err == nil {
-			ws.WriteMessage(websocket.TextMessage, message)
+		for _, status := range s.server.getCurrentSerialStatus() {
+			message, err := json.Marshal(status)
+			if err == nil {
+				ws.WriteMessage(websocket.TextMessage, message)
+			}
 		}
 	}
 
@@ -1,5 +1,26 @@
 #include <Arduino.h>
 
+// Frame protocol. Version 1 sends 5-byte frames with a 7-bit XOR checksum
+// and reports lost steps with overflow markers. Version 2 sends 9-byte
+// frames with a header, a sequence number counting every encoder step and
+// a CRC-8, so the receiver knows exactly how many steps were lost.
+#define PROTOCOL_VERSION 2
+
+// Set to 1 to stream frames over WiFi to a receiver started with the
+// "tcp-listen" transport instead of writing them to the serial port
+#define USE_WIFI 0
+
+#if USE_WIFI
+#include <ESP8266WiFi.h>
+
+const char *wifiSSID = "ssid";
+const char *wifiPassword = "password";
+const char *receiverHost = "192.168.1.2";
+const uint16_t receiverPort = 9000;
+
+WiFiClient client;
+#endif
+
 // Pins
 const uint8_t pinA = D5;
 const uint8_t pinB = D8;
@@ -14,12 +35,14 @@ volatile uint8_t lastState = 0;
 const uint16_t BUFFER_SIZE = 100;
 struct Reading {
     uint32_t timestamp;
+    uint16_t sequence;
     uint8_t direction;
 };
 volatile Reading buffer[BUFFER_SIZE];
 volatile uint16_t writeIndex = 0;
 volatile uint16_t readIndex = 0;
 volatile bool bufferFull = false;
+volatile uint16_t sequence = 0;         // Incremented for every step, sent or not
 
 void IRAM_ATTR handleEncoder() {
     uint8_t stateA = digitalRead(pinA);
@@ -53,16 +76,20 @@ void IRAM_ATTR handleEncoder() {
     }
     
     lastState = currentState;
+    uint16_t stepSequence = sequence++;
     
     // Update buffer instead of single variables
     uint16_t nextIndex = (writeIndex + 1) % BUFFER_SIZE;
     if (nextIndex == readIndex) {
         // Buffer is full
+#if PROTOCOL_VERSION == 1
         collisionCount++;
+#endif
         return;
     }
     
     buffer[writeIndex].timestamp = micros();
+    buffer[writeIndex].sequence = stepSequence;
     buffer[writeIndex].direction = direction;
     writeIndex = nextIndex;
     newData = true;
@@ -76,21 +103,74 @@ void setup() {
     attachInterrupt(digitalPinToInterrupt(pinB), handleEncoder, CHANGE);
 
     Serial.begin(115200);
+
+#if USE_WIFI
+    WiFi.mode(WIFI_STA);
+    WiFi.begin(wifiSSID, wifiPassword);
+#endif
+}
+
+// CRC-8 with polynomial 0x31 and initial value 0xFF, as used by the SHT85
+uint8_t crc8(const uint8_t *data, int len) {
+    uint8_t crc = 0xFF;
+    for (int i = 0; i < len; i++) {
+        crc ^= data[i];
+        for (int bit = 0; bit < 8; bit++) {
+            crc = (crc & 0x80) ? (crc << 1) ^ 0x31 : crc << 1;
+        }
+    }
+    return crc;
+}
+
+// Returns the stream frames should be written to, or NULL if the network
+// link is not up yet
+Print *output() {
+#if USE_WIFI
+    if (!client.connected()) {
+        if (WiFi.status() != WL_CONNECTED || !client.connect(receiverHost, receiverPort)) {
+            return NULL;
+        }
+        client.setNoDelay(true);
+    }
+    return &client;
+#else
+    return &Serial;
+#endif
 }
 
 void loop() {
+    Print *out = output();
+    if (out == NULL) {
+        return;
+    }
+
     if (newData) {
         if (collisionCount > 0) {
             // Send overflow marker (5 bytes of 0xFF)
             for (int i = 0; i < 5; i++) {
-                Serial.write(0xFF);
+                out->write(0xFF);
             }
             collisionCount--;
         } else if (readIndex != writeIndex) {  // Check if there's data to read
             // Normal data transmission
             uint32_t timestamp = buffer[readIndex].timestamp;
             uint8_t dir = buffer[readIndex].direction;
-            
+
+#if PROTOCOL_VERSION == 2
+            uint16_t seq = buffer[readIndex].sequence;
+            uint8_t frame[9];
+            frame[0] = 0xA5;
+            frame[1] = (seq >> 8) & 0xFF;
+            frame[2] = seq & 0xFF;
+            frame[3] = (timestamp >> 24) & 0xFF;
+            frame[4] = (timestamp >> 16) & 0xFF;
+            frame[5] = (timestamp >> 8) & 0xFF;
+            frame[6] = timestamp & 0xFF;
+            frame[7] = dir << 7;
+            frame[8] = crc8(frame, 8);
+
+            out->write(frame, sizeof(frame));
+#else
             // Calculate checksum byte by byte
             uint8_t checksum = 0;
             uint8_t bytes[4];
@@ -108,9 +188,10 @@ void loop() {
 
             // Send the data
             for (int i = 0; i < 4; i++) {
-                Serial.write(bytes[i]);
+                out->write(bytes[i]);
             }
-            Serial.write(finalByte);
+            out->write(finalByte);
+#endif
             
             readIndex = (readIndex + 1) % BUFFER_SIZE;
         }